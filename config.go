@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	//prefix of the environment variables overriding flags, e.g., TBLOAD_PASSWORD for -password
+	EnvPrefix = "TBLOAD_"
+
+	//flag of the config file, also read from TBLOAD_CONFIG
+	configFlag = "config"
+)
+
+//sharedEnvFlags mean the same in every command, so they are also read from TBLOAD_<FLAG>, e.g., TBLOAD_PASSWORD.
+//Other flags are only read from TBLOAD_<COMMAND>_<FLAG>, e.g., TBLOAD_RUN_CONCURRENT, and one-letter flags never.
+var sharedEnvFlags = map[string]bool{
+	"serverHost":  true,
+	"username":    true,
+	"password":    true,
+	"credentials": true,
+	"brokerUrl":   true,
+	"store":       true,
+	"workspace":   true,
+}
+
+//Config holds flag values by command name, then flag name, e.g.,
+//
+//	init:
+//	  serverHost: http://127.0.0.1:8080
+//	  deviceNum: 100
+//	run:
+//	  brokerUrl: tcp://127.0.0.1:1883
+type Config map[string]map[string]interface{}
+
+//LoadConfig reads a config file, which is json if its extension is .json and yaml otherwise
+func LoadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		//numbers are kept as written, a float64 would print 1000000 as 1e+06
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&config)
+	} else {
+		err = yaml.UnmarshalStrict(data, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+//envName returns the environment variable of a flag, e.g., TBLOAD_SERVER_HOST for serverHost
+func envName(flagName string) string {
+	var b strings.Builder
+	b.WriteString(EnvPrefix)
+	for i, r := range flagName {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+//commandEnvName returns the environment variable of a flag of a command, e.g., TBLOAD_RUN_CONCURRENT for -concurrent
+func commandEnvName(command, flagName string) string {
+	command = strings.ToUpper(strings.ReplaceAll(command, "-", "_"))
+	return EnvPrefix + command + "_" + strings.TrimPrefix(envName(flagName), EnvPrefix)
+}
+
+//lookupEnv returns the environment variable setting a flag of a command and its value
+func lookupEnv(command, flagName string) (string, string, bool) {
+	if len(flagName) == 1 {
+		return "", "", false
+	}
+
+	name := commandEnvName(command, flagName)
+	if value, ok := os.LookupEnv(name); ok {
+		return name, value, true
+	}
+	if sharedEnvFlags[flagName] {
+		name = envName(flagName)
+		value, ok := os.LookupEnv(name)
+		return name, value, ok
+	}
+	return "", "", false
+}
+
+//parseFlags parses args like fs.Parse, after adding the -config flag. A flag missing in args is then taken from
+//its environment variable (see lookupEnv), or else from the section of the config file named like fs.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	configPath := fs.String(configFlag, "", "yaml or json file with flags by command (e.g., tbload.yaml). "+
+		"flags override environment variables ("+EnvPrefix+"PASSWORD for -password) which override the file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if !set[configFlag] {
+		*configPath = os.Getenv(envName(configFlag))
+	}
+	var section map[string]interface{}
+	if len(*configPath) > 0 {
+		config, err := LoadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		section = config[fs.Name()]
+
+		for name := range section {
+			if fs.Lookup(name) == nil || name == configFlag {
+				return fmt.Errorf("config %s: %s has no flag -%s", *configPath, fs.Name(), name)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == configFlag {
+			return
+		}
+
+		if name, value, ok := lookupEnv(fs.Name(), f.Name); ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("%s: invalid value %q for flag -%s: %v", name, value, f.Name, e)
+			}
+		} else if value, ok := section[f.Name]; ok {
+			if e := fs.Set(f.Name, configValue(value)); e != nil {
+				err = fmt.Errorf("config %s: invalid value %v for flag -%s: %v", *configPath, value, f.Name, e)
+			}
+		}
+	})
+	return err
+}
+
+//configValue formats a value of a config file as a flag, lists are joined by commas
+func configValue(value interface{}) string {
+	list, ok := value.([]interface{})
+	if !ok {
+		return fmt.Sprint(value)
+	}
+
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = configValue(item)
+	}
+	return strings.Join(items, ",")
+}
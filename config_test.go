@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//writeConfig writes a config file named name in a directory removed when the test ends
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "tbload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//setEnv sets an environment variable until the test ends
+func setEnv(t *testing.T, key, value string) {
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Unsetenv(key) })
+}
+
+func TestParseFlags_Precedence(t *testing.T) {
+	path := writeConfig(t, "tbload.yaml", `
+init:
+  serverHost: http://file
+  username: file
+  password: file
+  deviceNum: 5
+run:
+  brokerUrl: tcp://file
+`)
+	setEnv(t, "TBLOAD_USERNAME", "env")
+	setEnv(t, "TBLOAD_PASSWORD", "env")
+
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	serverHost := fs.String("serverHost", "", "")
+	username := fs.String("username", "", "")
+	password := fs.String("password", "", "")
+	deviceNum := fs.Int("deviceNum", 1, "")
+	workers := fs.Int("workers", 4, "")
+
+	if err := parseFlags(fs, []string{"-config", path, "-password", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if *serverHost != "http://file" || *username != "env" || *password != "flag" || *deviceNum != 5 || *workers != 4 {
+		t.Fatalf("unexpected flags %s %s %s %d %d", *serverHost, *username, *password, *deviceNum, *workers)
+	}
+}
+
+func TestParseFlags_Json(t *testing.T) {
+	path := writeConfig(t, "tbload.json", `{"query": {"mix": ["latest=1", "devices=2"], "requests": 1000000}}`)
+	setEnv(t, "TBLOAD_CONFIG", path)
+
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	mix := fs.String("mix", "", "")
+	requests := fs.Int("requests", 0, "")
+
+	if err := parseFlags(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if *mix != "latest=1,devices=2" || *requests != 1000000 {
+		t.Fatalf("unexpected flags %s %d", *mix, *requests)
+	}
+}
+
+func TestParseFlags_Invalid(t *testing.T) {
+	cases := []struct {
+		name, content string
+	}{
+		{"unknown.yaml", "run:\n  brokerURL: tcp://file\n"},
+		{"value.yaml", "run:\n  concurrent: many\n"},
+		{"syntax.json", `{"run": `},
+	}
+
+	for _, c := range cases {
+		fs := flag.NewFlagSet("run", flag.ContinueOnError)
+		fs.String("brokerUrl", "", "")
+		fs.Int("concurrent", 1, "")
+
+		if err := parseFlags(fs, []string{"-config", writeConfig(t, c.name, c.content)}); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	cases := map[string]string{
+		"password":   "TBLOAD_PASSWORD",
+		"serverHost": "TBLOAD_SERVER_HOST",
+		"brokerUrl":  "TBLOAD_BROKER_URL",
+	}
+
+	for flagName, expected := range cases {
+		if name := envName(flagName); name != expected {
+			t.Errorf("%s: expected %s, got %s", flagName, expected, name)
+		}
+	}
+
+	if name := commandEnvName("fake-server", "mqttAddr"); name != "TBLOAD_FAKE_SERVER_MQTT_ADDR" {
+		t.Errorf("expected TBLOAD_FAKE_SERVER_MQTT_ADDR, got %s", name)
+	}
+}
+
+func TestParseFlags_CommandEnv(t *testing.T) {
+	setEnv(t, "TBLOAD_D", "true")
+	setEnv(t, "TBLOAD_INFO_D", "true")
+	setEnv(t, "TBLOAD_H", "true")
+	setEnv(t, "TBLOAD_CONCURRENT", "5")
+	setEnv(t, "TBLOAD_QUERY_CONCURRENT", "7")
+	setEnv(t, "TBLOAD_BROKER_URL", "tcp://env")
+	setEnv(t, "TBLOAD_RUN_BROKER_URL", "tcp://run")
+
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	help := fs.Bool("h", false, "")
+	brokerUrl := fs.String("brokerUrl", "", "")
+	concurrent := fs.Int("concurrent", 1, "")
+	if err := parseFlags(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *help || *brokerUrl != "tcp://run" || *concurrent != 1 {
+		t.Fatalf("unexpected run flags %v %s %d", *help, *brokerUrl, *concurrent)
+	}
+
+	fs = flag.NewFlagSet("info", flag.ContinueOnError)
+	printKVs := fs.Bool("d", false, "")
+	if err := parseFlags(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *printKVs {
+		t.Fatal("a one-letter flag is set by the environment")
+	}
+
+	fs = flag.NewFlagSet("query", flag.ContinueOnError)
+	concurrent = fs.Int("concurrent", 1, "")
+	if err := parseFlags(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *concurrent != 7 {
+		t.Fatalf("expected concurrent 7, got %d", *concurrent)
+	}
+}
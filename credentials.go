@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+//how init saves the tenant credentials in store
+const (
+	CredentialsRefreshToken = "refreshToken" //only the refresh token of the login
+	CredentialsEncrypted    = "encrypted"    //the password, encrypted with the key of TBLOAD_KEY or TBLOAD_KEY_FILE
+	CredentialsNone         = "none"         //nothing, the password is given by TBLOAD_PASSWORD
+)
+
+const (
+	//environment variables of the key which encrypts the password
+	EnvKey     = EnvPrefix + "KEY"
+	EnvKeyFile = EnvPrefix + "KEY_FILE"
+
+	redacted = "******"
+)
+
+var (
+	ErrNoKey = fmt.Errorf("no key to encrypt the password, set %s or %s", EnvKey, EnvKeyFile)
+
+	//secretPattern matches the json members PrintAll redacts
+	secretPattern = regexp.MustCompile(`"(password|encryptedPassword|refreshToken|provisionDeviceSecret)"\s*:\s*"(?:[^"\\]|\\.)+"`)
+)
+
+//secretKey returns the AES-256 key hashed from TBLOAD_KEY, or else the file named by TBLOAD_KEY_FILE
+func secretKey() ([]byte, error) {
+	secret := os.Getenv(EnvKey)
+	if len(secret) == 0 {
+		path := os.Getenv(EnvKeyFile)
+		if len(path) == 0 {
+			return nil, ErrNoKey
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+
+	if len(secret) == 0 {
+		return nil, ErrNoKey
+	}
+	key := sha256.Sum256([]byte(secret))
+	return key[:], nil
+}
+
+//encrypt seals plaintext with AES-GCM, the result is the base64 of the nonce and the ciphertext
+func encrypt(key []byte, plaintext string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+//decrypt opens what encrypt sealed with the same key
+func decrypt(key []byte, encrypted string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	} else if len(data) < aead.NonceSize() {
+		return "", errors.New("encrypted password too short")
+	}
+
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt password, is the key of %s or %s wrong? %v", EnvKey, EnvKeyFile, err)
+	}
+	return string(plaintext), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//checkCredentials checks the credentials mode of info can be saved
+func (info *InitCommandInfo) checkCredentials() error {
+	switch info.Credentials {
+	case CredentialsRefreshToken, CredentialsNone:
+		return nil
+	case CredentialsEncrypted:
+		_, err := secretKey()
+		return err
+	default:
+		return fmt.Errorf("unknown credentials[%s]", info.Credentials)
+	}
+}
+
+//keepCredentials keeps the credentials of the logged in user in info as its credentials mode says
+func (info *InitCommandInfo) keepCredentials(user *TenantUser) error {
+	switch info.Credentials {
+	case CredentialsRefreshToken:
+		info.RefreshToken = user.RefreshToken
+	case CredentialsEncrypted:
+		//a user logged in with the refresh token has no password to encrypt
+		if len(user.Password) == 0 {
+			return nil
+		}
+
+		key, err := secretKey()
+		if err != nil {
+			return err
+		}
+		if info.EncryptedPassword, err = encrypt(key, user.Password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//saveRefreshToken saves the refresh token user got last in the init info of store. Thingsboard gives a new one
+//on every login and refresh, the next command starts from it instead of an expired one.
+func saveRefreshToken(store *DeviceStore, user *TenantUser) error {
+	user.mu.Lock()
+	refreshToken := user.RefreshToken
+	user.mu.Unlock()
+
+	var info InitCommandInfo
+	if err := info.Restore(store); err != nil {
+		return err
+	} else if info.Credentials != CredentialsRefreshToken || len(refreshToken) == 0 || refreshToken == info.RefreshToken {
+		return nil
+	}
+
+	info.RefreshToken = refreshToken
+	return info.Store(store)
+}
+
+//password returns the password given by flag, the one saved encrypted, or else TBLOAD_PASSWORD
+func (info *InitCommandInfo) password() (string, error) {
+	if len(info.Password) > 0 {
+		return info.Password, nil
+	}
+
+	if len(info.EncryptedPassword) > 0 {
+		key, err := secretKey()
+		if err != nil {
+			return "", err
+		}
+		return decrypt(key, info.EncryptedPassword)
+	}
+
+	return os.Getenv(envName("password")), nil
+}
+
+//tenantUser logs in the tenant user of info with its password, or else the saved refresh token. If neither works
+//the password is asked by prompt, which may be nil.
+func (info *InitCommandInfo) tenantUser(ctx context.Context, prompt func(username string) (string, error)) (*TenantUser, error) {
+	password, err := info.password()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := NewTenantUser(info.ServerHost, info.Username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(password) == 0 {
+		if len(info.RefreshToken) > 0 {
+			if err = user.LoginWithRefreshToken(ctx, info.RefreshToken); err == nil {
+				return user, nil
+			}
+		}
+
+		if prompt == nil {
+			if err != nil {
+				return nil, fmt.Errorf("saved refresh token of %s: %v, set %s", info.Username, err, envName("password"))
+			}
+			return nil, fmt.Errorf("no password of %s saved, set %s", info.Username, envName("password"))
+		}
+
+		if user.Password, err = prompt(info.Username); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = user.Login(ctx); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+//redacted returns info without its secrets, to be printed
+func (info InitCommandInfo) redacted() InitCommandInfo {
+	for _, secret := range []*string{&info.Password, &info.EncryptedPassword, &info.RefreshToken, &info.Profile.ProvisionDeviceSecret} {
+		if len(*secret) > 0 {
+			*secret = redacted
+		}
+	}
+	return info
+}
+
+//redactSecrets replaces the values of secret json members in value
+func redactSecrets(value []byte) []byte {
+	return secretPattern.ReplaceAll(value, []byte(`"$1":"`+redacted+`"`))
+}
+
+//promptPassword returns a prompt which asks for the password on w and reads it from r, without echo if r is a terminal
+func promptPassword(r io.Reader, w io.Writer) func(username string) (string, error) {
+	return func(username string) (string, error) {
+		fmt.Fprintf(w, "password of %s: ", username)
+		if f, ok := r.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+			password, err := term.ReadPassword(int(f.Fd()))
+			fmt.Fprintln(w)
+			return string(password), err
+		}
+
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", fmt.Errorf("read password: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+}
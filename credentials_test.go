@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	setEnv(t, EnvKey, "key")
+	key, err := secretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := encrypt(key, "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, "tenant") {
+		t.Fatalf("password in plaintext %s", encrypted)
+	}
+
+	if password, err := decrypt(key, encrypted); err != nil || password != "tenant" {
+		t.Fatalf("expected tenant, got %s %v", password, err)
+	}
+
+	//the key may come from a file as well
+	setEnv(t, EnvKey, "")
+	setEnv(t, EnvKeyFile, writeConfig(t, "key", "other\n"))
+	if key, err = secretKey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decrypt(key, encrypted); err == nil {
+		t.Fatal("expected a wrong key to fail")
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	value := `{"username":"tenant","password":"p\"w","refreshToken":"","profile":{"provisionDeviceSecret":"s"}}`
+	expected := `{"username":"tenant","password":"******","refreshToken":"","profile":{"provisionDeviceSecret":"******"}}`
+	if redacted := string(redactSecrets([]byte(value))); redacted != expected {
+		t.Fatalf("expected %s, got %s", expected, redacted)
+	}
+}
+
+func TestInitCommandInfo_StoreWithoutPassword(t *testing.T) {
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Drop() }()
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := InitCommandInfo{ServerHost: "http://localhost:8080", Username: FakeUsername, Password: "secret", RefreshToken: "token"}
+	if err = info.Store(store); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := store.Get(KeyInitCmdInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(value, []byte("secret")) || !bytes.Contains(value, []byte("token")) {
+		t.Fatalf("unexpected info saved %s", value)
+	}
+
+	var printed bytes.Buffer
+	if err = store.PrintAll(&printed); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(printed.String(), "token") {
+		t.Fatalf("refresh token printed %s", printed.String())
+	}
+}
+
+func TestSaveRefreshToken(t *testing.T) {
+	initFakeServer(t, "-deviceNum", "1")
+	refreshToken := func() string {
+		store, err := OpenDeviceStore(DbFileName)
+		defer func() { _ = store.Close() }()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info InitCommandInfo
+		if err = info.Restore(store); err != nil {
+			t.Fatal(err)
+		}
+		return info.RefreshToken
+	}
+
+	//the command logs in with the saved refresh token and saves the one it got back
+	saved := refreshToken()
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	if err := main.Run(context.Background(), "query", "-duration", "0", "-requests", "1", "-mix", "devices"); err != nil {
+		t.Fatal(err)
+	}
+	if rotated := refreshToken(); len(rotated) == 0 || rotated == saved {
+		t.Fatalf("expected a new refresh token saved, got %s", rotated)
+	}
+}
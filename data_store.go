@@ -1,67 +1,223 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 )
 
 const (
 	DbFileName    = "store.db"
-	BucketDevices = "bkt_devices"
+	BucketMeta    = "meta"    //init info and the schema version
+	BucketDevices = "devices" //devices by name
+	BucketRuns    = "runs"    //what the last run published and its summary
+
+	//the only bucket of schema version 1
+	bucketLegacy = "bkt_devices"
+
+	//SchemaVersion is the layout of the buckets written by this version
+	SchemaVersion = 2
 )
 
 var (
 	ErrDeviceNotExist       = errors.New("device not exist")
-	ErrDeviceIdEmpty        = errors.New("deviceId is empty")
 	ErrDeviceNameEmpty      = errors.New("deviceName is empty")
 	ErrDeviceAuthTokenEmpty = errors.New("device's authToken is empty")
+
+	//keyBuckets are the buckets of keys which aren't devices
+	keyBuckets = map[Key]string{
+		KeySchemaVersion: BucketMeta,
+		KeyInitCmdInfo:   BucketMeta,
+		KeyRunCmdInfo:    BucketRuns,
+		KeySummary:       BucketRuns,
+		KeyQuerySummary:  BucketRuns,
+	}
+
+	//migrations[v] migrates a store of schema version v to v+1
+	migrations = map[int]func(tx *bolt.Tx) error{
+		1: splitLegacyBucket,
+	}
 )
 
 //DeviceStore save created device info
 type DeviceStore struct {
 	*bolt.DB
+	path string
 }
 
 type Key string
 type Value []byte
 
-//Open opens a boltDb
-func OpenDeviceStore() (*DeviceStore, error) {
-	db, err := bolt.Open(DbFileName, 0600, &bolt.Options{Timeout: 1 * time.Second})
+//Open opens the boltDb at path, its directory is created if missing
+func OpenDeviceStore(path string) (*DeviceStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return &DeviceStore{}, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return &DeviceStore{}, err
+	}
+
+	if err = db.Update(migrate); err != nil {
+		_ = db.Close()
+		return &DeviceStore{}, fmt.Errorf("store %s: %v", path, err)
+	}
+	return &DeviceStore{db, path}, nil
+}
+
+//OpenDeviceStoreReadOnly opens the boltDb at path to read it, sharing it with other readers. It isn't migrated,
+//the keys of an older schema are read from its buckets. It fails with bolt.ErrTimeout while a command writes it.
+func OpenDeviceStoreReadOnly(path string, timeout time.Duration) (*DeviceStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout, ReadOnly: true})
 	if err != nil {
 		return &DeviceStore{}, err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err2 := tx.CreateBucketIfNotExists([]byte(BucketDevices)); err2 != nil {
-			return err2
+	err = db.View(func(tx *bolt.Tx) error {
+		if version, err := schemaVersion(tx); err != nil {
+			return err
+		} else if version > SchemaVersion {
+			return fmt.Errorf("schema version %d is newer than %d, upgrade tbload", version, SchemaVersion)
 		}
 		return nil
 	})
-	return &DeviceStore{db}, nil
+	if err != nil {
+		_ = db.Close()
+		return &DeviceStore{}, fmt.Errorf("store %s: %v", path, err)
+	}
+	return &DeviceStore{db, path}, nil
+}
+
+//migrate creates the buckets of a new store, or migrates an older one to SchemaVersion
+func migrate(tx *bolt.Tx) error {
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	} else if version > SchemaVersion {
+		return fmt.Errorf("schema version %d is newer than %d, upgrade tbload", version, SchemaVersion)
+	}
+
+	for ; version < SchemaVersion; version++ {
+		if err = migrations[version](tx); err != nil {
+			return fmt.Errorf("migrate schema version %d: %v", version, err)
+		}
+	}
+
+	for _, name := range []string{BucketMeta, BucketDevices, BucketRuns} {
+		if _, err = tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	meta := tx.Bucket([]byte(BucketMeta))
+	return meta.Put([]byte(KeySchemaVersion), []byte(strconv.Itoa(SchemaVersion)))
+}
+
+//schemaVersion returns the schema version of a store. Version 1 had no version key, a new store has the current one.
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	if meta := tx.Bucket([]byte(BucketMeta)); meta != nil {
+		if value := meta.Get([]byte(KeySchemaVersion)); value != nil {
+			version, err := strconv.Atoi(string(value))
+			if err != nil {
+				return 0, fmt.Errorf("schema version %q: %v", value, err)
+			}
+			return version, nil
+		}
+	}
+
+	if tx.Bucket([]byte(bucketLegacy)) != nil {
+		return 1, nil
+	}
+	return SchemaVersion, nil
+}
+
+//splitLegacyBucket moves every key of bkt_devices to its bucket. The init info of version 1 kept the password,
+//which is left out, it keeps the refresh token of the next login instead like a new init.
+func splitLegacyBucket(tx *bolt.Tx) error {
+	legacy := tx.Bucket([]byte(bucketLegacy))
+	err := legacy.ForEach(func(k, v []byte) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucketOf(Key(k))))
+		if err != nil {
+			return err
+		}
+
+		if Key(k) == KeyInitCmdInfo {
+			if v, err = withoutPassword(v); err != nil {
+				return err
+			}
+		}
+		return bkt.Put(k, v)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.DeleteBucket([]byte(bucketLegacy))
+}
+
+//withoutPassword returns the init info value without its password and with the default credentials mode,
+//other members are kept as they are
+func withoutPassword(value []byte) ([]byte, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(value, &object); err != nil {
+		return nil, fmt.Errorf("%s: %v", KeyInitCmdInfo, err)
+	}
+
+	delete(object, "password")
+	if _, ok := object["credentials"]; !ok {
+		object["credentials"] = json.RawMessage(strconv.Quote(CredentialsRefreshToken))
+	}
+	return json.Marshal(object)
+}
+
+//bucketOf returns the bucket of key
+func bucketOf(key Key) string {
+	if name, ok := keyBuckets[key]; ok {
+		return name
+	}
+	return BucketDevices
+}
+
+//bucket returns the bucket of key in tx
+func bucket(tx *bolt.Tx, key Key) (*bolt.Bucket, error) {
+	bkt := tx.Bucket([]byte(bucketOf(key)))
+	if bkt == nil {
+		//a store opened read-only isn't migrated
+		if legacy := tx.Bucket([]byte(bucketLegacy)); legacy != nil {
+			return legacy, nil
+		}
+		return nil, fmt.Errorf("bucket %s not exist", bucketOf(key))
+	}
+	return bkt, nil
 }
 
-//Close closes store
+//Close closes store, a store which failed to open has nothing to close
 func (store *DeviceStore) Close() error {
+	if store.DB == nil {
+		return nil
+	}
 	return store.DB.Close()
 }
 
 //Drop deletes db file.
 func (store *DeviceStore) Drop() error {
-	return os.Remove(DbFileName)
+	return os.Remove(store.path)
 }
 
 //Put puts key value pair
 func (store *DeviceStore) Put(key Key, value Value) error {
 	err := store.DB.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(BucketDevices))
-		if bkt == nil {
-			return fmt.Errorf("bucket not exist")
+		bkt, err := bucket(tx, key)
+		if err != nil {
+			return err
 		}
 
 		if err := bkt.Put([]byte(key), value); err != nil {
@@ -82,9 +238,9 @@ func (store *DeviceStore) Get(key Key) (Value, error) {
 	var data []byte
 
 	err := store.DB.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(BucketDevices))
-		if bkt == nil {
-			return fmt.Errorf("bucket not exist")
+		bkt, err := bucket(tx, key)
+		if err != nil {
+			return err
 		}
 
 		data = bkt.Get([]byte(key))
@@ -97,6 +253,32 @@ func (store *DeviceStore) Get(key Key) (Value, error) {
 	return data, nil
 }
 
+//Update puts and deletes key value pairs in a single transaction
+func (store *DeviceStore) Update(puts map[Key]Value, deletes ...Key) error {
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		for key, value := range puts {
+			bkt, err := bucket(tx, key)
+			if err != nil {
+				return err
+			}
+			if err = bkt.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+
+		for _, key := range deletes {
+			bkt, err := bucket(tx, key)
+			if err != nil {
+				return err
+			}
+			if err = bkt.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 //Save saves device info
 func (store *DeviceStore) SaveDevice(device *Device) error {
 	if len(device.Name) == 0 {
@@ -138,11 +320,6 @@ func (store *DeviceStore) GetDevice(deviceName string) (*Device, error) {
 		return &Device{}, ErrDeviceNameEmpty
 	}
 
-	if len(device.Id) == 0 {
-		fmt.Printf("device[%s] has not id in store", deviceName)
-		return &Device{}, ErrDeviceIdEmpty
-	}
-
 	if len(device.AuthToken) == 0 {
 		fmt.Printf("device[%s] has not authToken in store", deviceName)
 		return &Device{}, ErrDeviceAuthTokenEmpty
@@ -151,18 +328,111 @@ func (store *DeviceStore) GetDevice(deviceName string) (*Device, error) {
 	return &device, nil
 }
 
-func (store *DeviceStore) PrintAll(writer io.Writer) error {
-	fmt.Fprintln(writer, "key-values in store:")
-	_ = store.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(BucketDevices))
+//SaveSummary saves summary of a run
+func (store *DeviceStore) SaveSummary(key Key, summary Summary) error {
+	bytes, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(key, Value(bytes))
+}
+
+//GetSummary gets summary of a run
+func (store *DeviceStore) GetSummary(key Key) (Summary, error) {
+	value, err := store.Get(key)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	if len(value) == 0 {
+		return Summary{}, fmt.Errorf("%s not exist", key)
+	}
+
+	var summary Summary
+	if err = json.Unmarshal(value, &summary); err != nil {
+		return Summary{}, err
+	}
+
+	if len(summary.PublishPerformance) > 0 {
+		summary.PublishPerformanceHistogram = buildHistogram(summary.PublishPerformance, summary.Completed)
+	}
+
+	return summary, nil
+}
+
+//SaveQuerySummary saves summary of a query run
+func (store *DeviceStore) SaveQuerySummary(summary QuerySummary) error {
+	bytes, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(KeyQuerySummary, Value(bytes))
+}
+
+//GetQuerySummary gets summary of the last query run
+func (store *DeviceStore) GetQuerySummary() (QuerySummary, error) {
+	value, err := store.Get(KeyQuerySummary)
+	if err != nil {
+		return QuerySummary{}, err
+	}
+
+	if len(value) == 0 {
+		return QuerySummary{}, fmt.Errorf("%s not exist, query first", KeyQuerySummary)
+	}
+
+	var summary QuerySummary
+	err = json.Unmarshal(value, &summary)
+	return summary, err
+}
 
-		c := bucket.Cursor()
+//ListDevices lists devices named namePrefix_N
+func (store *DeviceStore) ListDevices(namePrefix string) ([]*Device, error) {
+	var devices []*Device
+	err := store.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(BucketDevices))
+		if bkt == nil {
+			return fmt.Errorf("bucket not exist")
+		}
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			fmt.Fprintf(writer, "- key=%s, value=%s\n", k, v)
+		prefix := []byte(namePrefix + "_")
+		c := bkt.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			//devices of a longer prefix share a short one, e.g. load_a_0 and load
+			if _, err := strconv.Atoi(string(k[len(prefix):])); err != nil {
+				continue
+			}
+
+			var device Device
+			if err := json.Unmarshal(v, &device); err != nil {
+				return err
+			}
+			devices = append(devices, &device)
 		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
 
+//PrintAll prints the key value pairs of every bucket, with secrets redacted
+func (store *DeviceStore) PrintAll(writer io.Writer) error {
+	fmt.Fprintln(writer, "key-values in store:")
+	return store.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{BucketMeta, BucketDevices, BucketRuns} {
+			fmt.Fprintf(writer, "%s:\n", name)
+			err := tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				fmt.Fprintf(writer, "- key=%s, value=%s\n", k, redactSecrets(v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
-	return nil
 }
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"strconv"
 	"testing"
+
+	"github.com/boltdb/bolt"
 )
 
 func TestOpenDeviceStore(t *testing.T) {
-	store, err := OpenDeviceStore()
+	store, err := OpenDeviceStore(DbFileName)
 	defer store.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -16,7 +19,7 @@ func TestOpenDeviceStore(t *testing.T) {
 }
 
 func TestDeviceStore_Drop(t *testing.T) {
-	store, err := OpenDeviceStore()
+	store, err := OpenDeviceStore(DbFileName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -32,7 +35,7 @@ func TestDeviceStore_Drop(t *testing.T) {
 }
 
 func TestDeviceStore_PutGet(t *testing.T) {
-	store, err := OpenDeviceStore()
+	store, err := OpenDeviceStore(DbFileName)
 	defer store.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -56,14 +59,99 @@ func TestDeviceStore_PutGet(t *testing.T) {
 }
 
 func TestDeviceStore_GetDevice(t *testing.T) {
-	store, err := OpenDeviceStore()
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Close() }()
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	saved := &Device{Id: "device-id", Name: "_tbload_device_0", Type: "default", AuthToken: "token"}
+	if err = store.SaveDevice(saved); err != nil {
+		t.Fatal(err)
+	}
+
 	store.PrintAll(os.Stdout)
 	device, err := store.GetDevice("_tbload_device_0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Printf("%+v\n", device)
+
+	if *device != *saved {
+		t.Fatalf("expected %+v, got %+v", saved, device)
+	}
+
+	if _, err = store.GetDevice("missing"); err != ErrDeviceNotExist {
+		t.Fatalf("expected ErrDeviceNotExist, got %v", err)
+	}
+}
+
+func TestOpenDeviceStore_Migrate(t *testing.T) {
+	_ = os.Remove(DbFileName)
+	defer func() { _ = os.Remove(DbFileName) }()
+
+	//a store of schema version 1 keeps everything in bkt_devices
+	legacy := map[string]string{
+		KeyInitCmdInfo:     `{"credentials":"refreshToken","deviceNum":1,"serverHost":"http://localhost:8080"}`,
+		KeySummary:         `{"Clients":1}`,
+		"_tbload_device_0": `{"Id":"device-id","Name":"_tbload_device_0","AuthToken":"token"}`,
+	}
+	db, err := bolt.Open(DbFileName, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte(bucketLegacy))
+		if err != nil {
+			return err
+		}
+		for k, v := range legacy {
+			if err = bkt.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		//the password saved by version 1 is left out of the migrated init info
+		return bkt.Put([]byte(KeyInitCmdInfo), []byte(`{"serverHost":"http://localhost:8080","password":"secret","deviceNum":1}`))
+	})
+	_ = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenDeviceStore(DbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketLegacy)) != nil {
+			t.Error("expected bkt_devices removed")
+		}
+		if version := tx.Bucket([]byte(BucketMeta)).Get([]byte(KeySchemaVersion)); string(version) != strconv.Itoa(SchemaVersion) {
+			t.Errorf("unexpected schema version %s", version)
+		}
+		for k, v := range legacy {
+			if value := tx.Bucket([]byte(bucketOf(Key(k)))).Get([]byte(k)); string(value) != v {
+				t.Errorf("%s: expected %s in %s, got %s", k, v, bucketOf(Key(k)), value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if devices, err := store.ListDevices(DeviceNamePrefix); err != nil || len(devices) != 1 {
+		t.Fatalf("expected the migrated device, got %v %v", devices, err)
+	}
+
+	//a store written by a newer version is not opened
+	err = store.Update(map[Key]Value{KeySchemaVersion: Value(strconv.Itoa(SchemaVersion + 1))})
+	_ = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store, err = OpenDeviceStore(DbFileName); err == nil {
+		_ = store.Close()
+		t.Fatal("expected a newer schema version to fail")
+	}
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	saveDeviceProfileEnding   = "/api/deviceProfile"
+	deleteDeviceProfileEnding = "/api/deviceProfile/"
+
+	tbAttributesTopic = "v1/devices/me/attributes"
+
+	PayloadTypeJson     = "JSON"
+	PayloadTypeProtobuf = "PROTOBUF"
+
+	ProvisionDisabled              = "DISABLED"
+	ProvisionAllowCreateNewDevices = "ALLOW_CREATE_NEW_DEVICES"
+	ProvisionCheckPreProvisioned   = "CHECK_PRE_PROVISIONED_DEVICES"
+)
+
+var (
+	ErrDeviceProfileNotExist = errors.New("device profile not exist")
+)
+
+//ProfileInfo describes the device profile created by init -createProfile
+type ProfileInfo struct {
+	TelemetryTopic        string `json:"telemetryTopic"`
+	AttributesTopic       string `json:"attributesTopic"`
+	PayloadType           string `json:"payloadType"`
+	ProvisionType         string `json:"provisionType"`
+	ProvisionDeviceKey    string `json:"provisionDeviceKey"`
+	ProvisionDeviceSecret string `json:"provisionDeviceSecret"`
+	AlarmRules            string `json:"alarmRules"`
+	ProtoSchema           string `json:"protoSchema"`
+}
+
+//DeviceProfile correspond to request and response data struct of /api/deviceProfile
+type DeviceProfile struct {
+	Id                 *EntityId         `json:"id,omitempty"`
+	Name               string            `json:"name"`
+	Type               string            `json:"type"`
+	TransportType      string            `json:"transportType"`
+	ProvisionType      string            `json:"provisionType"`
+	ProvisionDeviceKey string            `json:"provisionDeviceKey,omitempty"`
+	Description        string            `json:"description"`
+	ProfileData        DeviceProfileData `json:"profileData"`
+}
+
+type DeviceProfileData struct {
+	Configuration          TypedConfiguration     `json:"configuration"`
+	TransportConfiguration TransportConfiguration `json:"transportConfiguration"`
+	ProvisionConfiguration ProvisionConfiguration `json:"provisionConfiguration"`
+	Alarms                 json.RawMessage        `json:"alarms,omitempty"`
+}
+
+type TypedConfiguration struct {
+	Type string `json:"type"`
+}
+
+type TransportConfiguration struct {
+	Type                              string                   `json:"type"`
+	DeviceTelemetryTopic              string                   `json:"deviceTelemetryTopic"`
+	DeviceAttributesTopic             string                   `json:"deviceAttributesTopic"`
+	TransportPayloadTypeConfiguration PayloadTypeConfiguration `json:"transportPayloadTypeConfiguration"`
+}
+
+type PayloadTypeConfiguration struct {
+	TransportPayloadType       string `json:"transportPayloadType"`
+	DeviceTelemetryProtoSchema string `json:"deviceTelemetryProtoSchema,omitempty"`
+}
+
+type ProvisionConfiguration struct {
+	Type                  string `json:"type"`
+	ProvisionDeviceSecret string `json:"provisionDeviceSecret,omitempty"`
+}
+
+//NewDeviceProfile returns a mqtt device profile described by info, alarms is a json array of alarm rules and
+//telemetrySchema the .proto source of PROTOBUF payloads
+func NewDeviceProfile(name string, info ProfileInfo, alarms json.RawMessage, telemetrySchema string) *DeviceProfile {
+	profile := &DeviceProfile{
+		Name:          name,
+		Type:          "DEFAULT",
+		TransportType: "MQTT",
+		ProvisionType: info.ProvisionType,
+		Description:   "created by tbload",
+		ProfileData: DeviceProfileData{
+			Configuration: TypedConfiguration{Type: "DEFAULT"},
+			TransportConfiguration: TransportConfiguration{
+				Type:                  "MQTT",
+				DeviceTelemetryTopic:  info.TelemetryTopic,
+				DeviceAttributesTopic: info.AttributesTopic,
+				TransportPayloadTypeConfiguration: PayloadTypeConfiguration{
+					TransportPayloadType:       info.PayloadType,
+					DeviceTelemetryProtoSchema: telemetrySchema,
+				},
+			},
+			ProvisionConfiguration: ProvisionConfiguration{Type: info.ProvisionType},
+			Alarms:                 alarms,
+		},
+	}
+
+	if info.ProvisionType != ProvisionDisabled {
+		profile.ProvisionDeviceKey = info.ProvisionDeviceKey
+		profile.ProfileData.ProvisionConfiguration.ProvisionDeviceSecret = info.ProvisionDeviceSecret
+	}
+	return profile
+}
+
+//SaveDeviceProfile creates the profile, or updates it if profile.Id is set, and returns its id
+func (u *TenantUser) SaveDeviceProfile(ctx context.Context, profile *DeviceProfile) (string, error) {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return "", err
+	}
+
+	all, err := u.do(ctx, http.MethodPost, u.ServerHost+saveDeviceProfileEnding, data)
+	if err != nil {
+		return "", err
+	}
+
+	var saved DeviceProfile
+	if err = json.Unmarshal(all, &saved); err != nil {
+		return "", err
+	}
+
+	if saved.Id == nil || len(saved.Id.Id) == 0 {
+		return "", fmt.Errorf("save device profile fail|msg=%s", string(all))
+	}
+	return saved.Id.Id, nil
+}
+
+//DeleteDeviceProfile deletes device profile on thingsboard
+func (u *TenantUser) DeleteDeviceProfile(ctx context.Context, profileId string) error {
+	_, err := u.do(ctx, http.MethodDelete, u.ServerHost+deleteDeviceProfileEnding+profileId, nil)
+	return err
+}
+
+//createDeviceProfile creates or updates the device profile named by -deviceProfile for the devices of init
+func createDeviceProfile(ctx context.Context, cmd *InitCommand) error {
+	info := &cmd.info
+	if len(info.DeviceProfile) == 0 {
+		info.DeviceProfile = info.namePrefix() + "_profile"
+	}
+
+	profile := &info.Profile
+	switch strings.ToUpper(profile.PayloadType) {
+	case PayloadTypeJson, PayloadTypeProtobuf:
+		profile.PayloadType = strings.ToUpper(profile.PayloadType)
+	default:
+		return fmt.Errorf("unknown payload type[%s]", profile.PayloadType)
+	}
+
+	switch profile.ProvisionType {
+	case ProvisionDisabled:
+	case ProvisionAllowCreateNewDevices, ProvisionCheckPreProvisioned:
+		if len(profile.ProvisionDeviceKey) == 0 {
+			profile.ProvisionDeviceKey = randomHex(10)
+		}
+		if len(profile.ProvisionDeviceSecret) == 0 {
+			profile.ProvisionDeviceSecret = randomHex(10)
+		}
+	default:
+		return fmt.Errorf("unknown provision type[%s]", profile.ProvisionType)
+	}
+
+	var telemetrySchema string
+	if profile.PayloadType == PayloadTypeProtobuf {
+		if _, err := readProtoSchema(profile.ProtoSchema); err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(profile.ProtoSchema)
+		if err != nil {
+			return err
+		}
+		telemetrySchema = string(data)
+	}
+
+	var alarms json.RawMessage
+	if len(profile.AlarmRules) > 0 {
+		data, err := ioutil.ReadFile(profile.AlarmRules)
+		if err != nil {
+			return err
+		}
+
+		var rules []json.RawMessage
+		if err = json.Unmarshal(data, &rules); err != nil {
+			return fmt.Errorf("alarm rules[%s] is not a json array: %v", profile.AlarmRules, err)
+		}
+		alarms = data
+	}
+
+	user, err := info.tenantUser(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	deviceProfile := NewDeviceProfile(info.DeviceProfile, *profile, alarms, telemetrySchema)
+
+	//an existing profile of the same name is updated
+	if id, err := user.GetDeviceProfileId(ctx, info.DeviceProfile); err == nil {
+		deviceProfile.Id = &EntityId{Id: id, EntityType: entityTypeDeviceProfile}
+	} else if err != ErrDeviceProfileNotExist {
+		return err
+	}
+
+	if info.DeviceProfileId, err = user.SaveDeviceProfile(ctx, deviceProfile); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "saved device profile[%s]\n", info.DeviceProfile)
+	return nil
+}
+
+//randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//telemetryTopic returns a topic matching the telemetry topic filter of the created profile, wildcards are
+//replaced by ToolPrefix
+func (info *InitCommandInfo) telemetryTopic() string {
+	if !info.CreateProfile || len(info.Profile.TelemetryTopic) == 0 {
+		return tbPubTopic
+	}
+
+	levels := strings.Split(info.Profile.TelemetryTopic, "/")
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			levels[i] = ToolPrefix
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+//payloadType returns the payload type of the created profile
+func (info *InitCommandInfo) payloadType() string {
+	if !info.CreateProfile || len(info.Profile.PayloadType) == 0 {
+		return PayloadTypeJson
+	}
+	return info.Profile.PayloadType
+}
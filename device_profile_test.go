@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateDeviceProfile(t *testing.T) {
+	var saved []DeviceProfile
+	existing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case loginEnding:
+			_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+		case "/api/deviceProfileInfos":
+			page := DeviceProfileInfoPage{}
+			if existing {
+				page.Data = []DeviceProfileInfo{{Id: EntityId{Id: "profile-id"}, Name: "load_profile"}}
+			}
+			_ = json.NewEncoder(w).Encode(page)
+		case saveDeviceProfileEnding:
+			var profile DeviceProfile
+			if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+				t.Error(err)
+			}
+			saved = append(saved, profile)
+			profile.Id = &EntityId{Id: "profile-id", EntityType: entityTypeDeviceProfile}
+			_ = json.NewEncoder(w).Encode(profile)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "tbload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	alarmRules := filepath.Join(dir, "alarms.json")
+	if err = ioutil.WriteFile(alarmRules, []byte(`[{"id":"high","alarmType":"High Temperature"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	protoSchema := filepath.Join(dir, "telemetry.proto")
+	if err = ioutil.WriteFile(protoSchema, []byte(testProtoSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &InitCommand{Stdout: &bytes.Buffer{}}
+	cmd.info = InitCommandInfo{
+		ServerHost:    server.URL,
+		Username:      "tenant@thingsboard.org",
+		Password:      "tenant",
+		NamePrefix:    "load",
+		CreateProfile: true,
+		Profile: ProfileInfo{
+			TelemetryTopic:  "sensors/+/telemetry",
+			AttributesTopic: tbAttributesTopic,
+			PayloadType:     "protobuf",
+			ProvisionType:   ProvisionAllowCreateNewDevices,
+			AlarmRules:      alarmRules,
+			ProtoSchema:     protoSchema,
+		},
+	}
+
+	if err = createDeviceProfile(context.Background(), cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.info.DeviceProfile != "load_profile" || cmd.info.DeviceProfileId != "profile-id" {
+		t.Fatalf("unexpected profile %s[%s]", cmd.info.DeviceProfile, cmd.info.DeviceProfileId)
+	}
+
+	profile := saved[0]
+	transport := profile.ProfileData.TransportConfiguration
+	if profile.Id != nil || transport.DeviceTelemetryTopic != "sensors/+/telemetry" ||
+		transport.TransportPayloadTypeConfiguration.TransportPayloadType != PayloadTypeProtobuf ||
+		transport.TransportPayloadTypeConfiguration.DeviceTelemetryProtoSchema != testProtoSchema {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+
+	if len(profile.ProvisionDeviceKey) == 0 || len(profile.ProfileData.ProvisionConfiguration.ProvisionDeviceSecret) == 0 {
+		t.Fatalf("expected generated provision credentials, got %+v", profile)
+	}
+
+	if len(profile.ProfileData.Alarms) == 0 {
+		t.Fatal("expected alarm rules")
+	}
+
+	if topic := cmd.info.telemetryTopic(); topic != "sensors/"+ToolPrefix+"/telemetry" {
+		t.Fatalf("unexpected telemetry topic %s", topic)
+	}
+
+	//a second init updates the profile of the same name
+	existing = true
+	if err = createDeviceProfile(context.Background(), cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved[1].Id == nil || saved[1].Id.Id != "profile-id" {
+		t.Fatalf("expected update of profile-id, got %+v", saved[1].Id)
+	}
+}
+
+func TestCreateDeviceProfile_Invalid(t *testing.T) {
+	cmd := &InitCommand{Stdout: &bytes.Buffer{}}
+	cmd.info.Profile = ProfileInfo{PayloadType: "XML", ProvisionType: ProvisionDisabled}
+	if err := createDeviceProfile(context.Background(), cmd); err == nil {
+		t.Fatal("expected error for unknown payload type")
+	}
+
+	cmd.info.Profile = ProfileInfo{PayloadType: PayloadTypeJson, ProvisionType: "ANY"}
+	if err := createDeviceProfile(context.Background(), cmd); err == nil {
+		t.Fatal("expected error for unknown provision type")
+	}
+}
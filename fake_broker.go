@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	//how long a new connection has to send CONNECT
+	brokerConnectTimeout = 10 * time.Second
+)
+
+var (
+	ErrBrokerClosed = errors.New("broker closed")
+)
+
+//FakeBrokerOptions are the faults a FakeBroker injects into every connection
+type FakeBrokerOptions struct {
+	Latency         time.Duration //delay of every acknowledgement
+	DropRate        float64       //fraction of QoS 1 and 2 publishes which are never acknowledged
+	DisconnectRate  float64       //fraction of publishes which close the connection instead of being acknowledged
+	RefuseRate      float64       //fraction of clients whose every CONNECT is refused
+	DisconnectAfter int           //publishes a connection accepts, the next one closes it. 0 means no limit
+	Bandwidth       int           //bytes per second a connection reads. 0 means no limit
+	DuplicateRate   float64       //fraction of publishes handed on twice, like a redelivery
+	ReorderRate     float64       //fraction of publishes held back until the next publish of the connection
+}
+
+//FakeBrokerStats counts what a FakeBroker has seen
+type FakeBrokerStats struct {
+	Connections  int64 //open connections
+	Connects     int64
+	Refused      int64
+	Published    int64
+	Acked        int64
+	Dropped      int64
+	Disconnected int64
+	Duplicated   int64
+	Reordered    int64
+}
+
+//FakeBroker is a minimal in-process MQTT 3.1.1 broker which authenticates devices by their access token
+//like thingsboard. It supports QoS 0, 1 and 2 publishes, subscriptions, and injects the faults of its
+//options. There is no retained message, will or persistent session.
+type FakeBroker struct {
+	Options FakeBrokerOptions
+
+	//Authenticate returns the device name of an access token, nil accepts any token
+	Authenticate func(token string) (string, error)
+
+	//OnPublish is called with every published message before it is acknowledged, it may be nil
+	OnPublish func(token, topic string, payload []byte)
+
+	listener net.Listener
+	stats    FakeBrokerStats
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	sessions map[*brokerSession]bool
+	refused  map[string]bool //client id to whether it is refused
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+//brokerSession is a connection of a FakeBroker
+type brokerSession struct {
+	conn      net.Conn
+	reader    io.Reader //conn, throttled to the bandwidth of the options
+	token     string
+	published int                    //publishes accepted, only used by the goroutine handling the session
+	held      *packets.PublishPacket //publish held back to be reordered, only used by the goroutine handling the session
+
+	mu        sync.Mutex //serializes writes to conn and guards filters and messageId
+	filters   map[string]byte
+	messageId uint16
+}
+
+//NewFakeBroker starts a FakeBroker listening on addr (e.g., 127.0.0.1:0).
+//The caller should call Close when finished.
+func NewFakeBroker(addr string, options FakeBrokerOptions) (*FakeBroker, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &FakeBroker{
+		Options:  options,
+		listener: listener,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		sessions: make(map[*brokerSession]bool),
+		refused:  make(map[string]bool),
+	}
+
+	b.wg.Add(1)
+	go b.serve()
+	return b, nil
+}
+
+//AllowTokens makes b accept only the access tokens of devices
+func (b *FakeBroker) AllowTokens(devices []*Device) {
+	names := make(map[string]string, len(devices))
+	for _, device := range devices {
+		names[device.AuthToken] = device.Name
+	}
+
+	b.Authenticate = func(token string) (string, error) {
+		name, ok := names[token]
+		if !ok {
+			return "", ErrDeviceNotExist
+		}
+		return name, nil
+	}
+}
+
+//URL returns the broker url of b for NewMqttClient
+func (b *FakeBroker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+//Stats returns a snapshot of the counters of b
+func (b *FakeBroker) Stats() FakeBrokerStats {
+	return FakeBrokerStats{
+		Connections:  atomic.LoadInt64(&b.stats.Connections),
+		Connects:     atomic.LoadInt64(&b.stats.Connects),
+		Refused:      atomic.LoadInt64(&b.stats.Refused),
+		Published:    atomic.LoadInt64(&b.stats.Published),
+		Acked:        atomic.LoadInt64(&b.stats.Acked),
+		Dropped:      atomic.LoadInt64(&b.stats.Dropped),
+		Disconnected: atomic.LoadInt64(&b.stats.Disconnected),
+		Duplicated:   atomic.LoadInt64(&b.stats.Duplicated),
+		Reordered:    atomic.LoadInt64(&b.stats.Reordered),
+	}
+}
+
+//Close stops accepting connections, closes every open one and waits for them to end
+func (b *FakeBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBrokerClosed
+	}
+	b.closed = true
+	err := b.listener.Close()
+	for session := range b.sessions {
+		_ = session.conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return err
+}
+
+func (b *FakeBroker) serve() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		session := &brokerSession{conn: conn, reader: throttle(conn, b.Options.Bandwidth), filters: make(map[string]byte)}
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		b.sessions[session] = true
+		b.wg.Add(1)
+		b.mu.Unlock()
+
+		go func() {
+			defer b.wg.Done()
+			b.handle(session)
+
+			b.mu.Lock()
+			delete(b.sessions, session)
+			b.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+//chance reports whether an event of probability rate happens
+func (b *FakeBroker) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rand.Float64() < rate
+}
+
+//handle serves a connection until it is closed
+func (b *FakeBroker) handle(s *brokerSession) {
+	if !b.connect(s) {
+		return
+	}
+	atomic.AddInt64(&b.stats.Connections, 1)
+	defer atomic.AddInt64(&b.stats.Connections, -1)
+
+	//a publish held back is handed on when there is no next one
+	defer func() {
+		if s.held != nil {
+			b.handOn(s, s.held)
+		}
+	}()
+
+	for {
+		packet, err := packets.ReadPacket(s.reader)
+		if err != nil {
+			return
+		}
+
+		switch p := packet.(type) {
+		case *packets.PublishPacket:
+			if !b.publish(s, p) {
+				return
+			}
+		case *packets.PubrelPacket:
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = p.MessageID
+			b.ack(s, pubcomp)
+		case *packets.PubrecPacket:
+			//the second step of a QoS 2 message delivered to s
+			pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubrel.MessageID = p.MessageID
+			_ = s.write(pubrel)
+		case *packets.PubackPacket, *packets.PubcompPacket:
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			s.mu.Lock()
+			for i, filter := range p.Topics {
+				s.filters[filter] = p.Qoss[i]
+				suback.ReturnCodes = append(suback.ReturnCodes, p.Qoss[i])
+			}
+			s.mu.Unlock()
+			_ = s.write(suback)
+		case *packets.UnsubscribePacket:
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			s.mu.Lock()
+			for _, filter := range p.Topics {
+				delete(s.filters, filter)
+			}
+			s.mu.Unlock()
+			_ = s.write(unsuback)
+		case *packets.PingreqPacket:
+			_ = s.write(packets.NewControlPacket(packets.Pingresp))
+		default:
+			//DISCONNECT, or a packet a client must not send
+			return
+		}
+	}
+}
+
+//connect reads CONNECT and answers with CONNACK, it reports whether the connection was accepted
+func (b *FakeBroker) connect(s *brokerSession) bool {
+	_ = s.conn.SetReadDeadline(time.Now().Add(brokerConnectTimeout))
+	packet, err := packets.ReadPacket(s.reader)
+	if err != nil {
+		return false
+	}
+	_ = s.conn.SetReadDeadline(time.Time{})
+
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return false
+	}
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connect.Validate()
+	if connack.ReturnCode == packets.Accepted && b.Authenticate != nil {
+		if _, err = b.Authenticate(connect.Username); err != nil {
+			connack.ReturnCode = packets.ErrRefusedNotAuthorised
+		}
+	}
+	if connack.ReturnCode == packets.Accepted && b.refuse(connect.ClientIdentifier) {
+		connack.ReturnCode = packets.ErrRefusedServerUnavailable
+	}
+
+	if connack.ReturnCode != packets.Accepted {
+		atomic.AddInt64(&b.stats.Refused, 1)
+		_ = s.write(connack)
+		return false
+	}
+
+	atomic.AddInt64(&b.stats.Connects, 1)
+	s.token = connect.Username
+	return s.write(connack) == nil
+}
+
+//refuse reports whether the connections of clientId are refused. Clients are refused in the order they
+//first connect, evenly spread so that the refused fraction is the refuse rate of the options.
+func (b *FakeBroker) refuse(clientId string) bool {
+	if b.Options.RefuseRate <= 0 {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	refused, ok := b.refused[clientId]
+	if !ok {
+		n := float64(len(b.refused))
+		refused = math.Floor((n+1)*b.Options.RefuseRate) > math.Floor(n*b.Options.RefuseRate)
+		b.refused[clientId] = refused
+	}
+	return refused
+}
+
+//publish handles a PUBLISH of s, it reports whether the connection stays open
+func (b *FakeBroker) publish(s *brokerSession, p *packets.PublishPacket) bool {
+	atomic.AddInt64(&b.stats.Published, 1)
+	if b.chance(b.Options.DisconnectRate) ||
+		(b.Options.DisconnectAfter > 0 && s.published >= b.Options.DisconnectAfter) {
+		atomic.AddInt64(&b.stats.Disconnected, 1)
+		return false
+	}
+	s.published++
+
+	if s.held == nil && b.chance(b.Options.ReorderRate) {
+		atomic.AddInt64(&b.stats.Reordered, 1)
+		s.held = p
+	} else {
+		b.handOn(s, p)
+		if s.held != nil {
+			b.handOn(s, s.held)
+			s.held = nil
+		}
+	}
+
+	switch p.Qos {
+	case 0:
+		return true
+	case 1:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		b.acknowledge(s, puback)
+	case 2:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.MessageID
+		b.acknowledge(s, pubrec)
+	default:
+		return false
+	}
+	return true
+}
+
+//handOn hands p to OnPublish and to the subscribers of its topic, twice at the duplicate rate of the options
+func (b *FakeBroker) handOn(s *brokerSession, p *packets.PublishPacket) {
+	n := 1
+	if b.chance(b.Options.DuplicateRate) {
+		atomic.AddInt64(&b.stats.Duplicated, 1)
+		n = 2
+	}
+
+	for i := 0; i < n; i++ {
+		if b.OnPublish != nil {
+			b.OnPublish(s.token, p.TopicName, p.Payload)
+		}
+		b.route(p)
+	}
+}
+
+//acknowledge sends the first acknowledgement of a publish unless it is dropped
+func (b *FakeBroker) acknowledge(s *brokerSession, ack packets.ControlPacket) {
+	if b.chance(b.Options.DropRate) {
+		atomic.AddInt64(&b.stats.Dropped, 1)
+		return
+	}
+	atomic.AddInt64(&b.stats.Acked, 1)
+	b.ack(s, ack)
+}
+
+//ack sends ack after the latency of the options
+func (b *FakeBroker) ack(s *brokerSession, ack packets.ControlPacket) {
+	if b.Options.Latency <= 0 {
+		_ = s.write(ack)
+		return
+	}
+	time.AfterFunc(b.Options.Latency, func() { _ = s.write(ack) })
+}
+
+//route delivers p to every session subscribed to its topic
+func (b *FakeBroker) route(p *packets.PublishPacket) {
+	b.mu.Lock()
+	sessions := make([]*brokerSession, 0, len(b.sessions))
+	for session := range b.sessions {
+		sessions = append(sessions, session)
+	}
+	b.mu.Unlock()
+
+	for _, session := range sessions {
+		session.deliver(p)
+	}
+}
+
+//deliver sends p to s with the lower QoS of p and the matching subscription
+func (s *brokerSession) deliver(p *packets.PublishPacket) {
+	s.mu.Lock()
+	var subscribed bool
+	var qos byte
+	for filter, filterQos := range s.filters {
+		if topicMatches(filter, p.TopicName) {
+			subscribed = true
+			if filterQos > qos {
+				qos = filterQos
+			}
+		}
+	}
+	if !subscribed {
+		s.mu.Unlock()
+		return
+	}
+
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = p.TopicName
+	publish.Payload = p.Payload
+	publish.Qos = qos
+	if p.Qos < qos {
+		publish.Qos = p.Qos
+	}
+	if publish.Qos > 0 {
+		s.messageId++
+		if s.messageId == 0 {
+			s.messageId++
+		}
+		publish.MessageID = s.messageId
+	}
+	s.mu.Unlock()
+
+	_ = s.write(publish)
+}
+
+func (s *brokerSession) write(p packets.ControlPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return p.Write(s.conn)
+}
+
+//throttledReader limits reads to bytesPerSec on average
+type throttledReader struct {
+	r           io.Reader
+	bytesPerSec int
+	next        time.Time //when the bytes read so far may have been read
+}
+
+//throttle returns r limited to bytesPerSec, or r itself if bytesPerSec is 0
+func throttle(r io.Reader, bytesPerSec int) io.Reader {
+	if bytesPerSec <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, bytesPerSec: bytesPerSec}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	//at most a second of bytes at once
+	if len(p) > t.bytesPerSec {
+		p = p[:t.bytesPerSec]
+	}
+
+	n, err := t.r.Read(p)
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.bytesPerSec))
+	time.Sleep(t.next.Sub(now))
+	return n, err
+}
+
+//topicMatches reports whether topic matches the MQTT topic filter, which may contain + and # wildcards
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		} else if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+type FakeBrokerCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	store    StoreFlags
+	addr     string
+	anyToken bool
+	options  FakeBrokerOptions
+}
+
+func newFakeBrokerCommand(m *Main) *FakeBrokerCommand {
+	return &FakeBrokerCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *FakeBrokerCommand) Run(ctx context.Context, args ...string) error {
+	fs := flag.NewFlagSet("fake-broker", flag.ContinueOnError)
+
+	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
+	fs.StringVar(&cmd.addr, "addr", "127.0.0.1:1883", "address to listen on")
+	fs.BoolVar(&cmd.anyToken, "anyToken", false, "accept any access token instead of the tokens of the devices in store")
+	addFakeBrokerFlags(fs, &cmd.options)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	} else if *help {
+		fs.Usage()
+		return nil
+	}
+
+	var devices []*Device
+	if !cmd.anyToken {
+		var err error
+		if _, devices, err = loadDevices(cmd.store); err != nil {
+			return err
+		} else if len(devices) == 0 {
+			return fmt.Errorf("no devices in store, run init first or use -anyToken")
+		}
+	}
+
+	broker, err := NewFakeBroker(cmd.addr, cmd.options)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = broker.Close() }()
+	if !cmd.anyToken {
+		broker.AllowTokens(devices)
+	}
+
+	fmt.Fprintf(cmd.Stdout, "fake mqtt broker listening on %s, stop with ctrl-c\n", broker.URL())
+	fmt.Fprintf(cmd.Stdout, "tbload run -brokerUrl %s\n", broker.URL())
+
+	ctx, cancel := notifyContext(ctx)
+	defer cancel()
+	broker.printStats(ctx, cmd.Stdout, progressInterval)
+	return nil
+}
+
+//addFakeBrokerFlags defines the flags of the faults a FakeBroker injects
+func addFakeBrokerFlags(fs *flag.FlagSet, options *FakeBrokerOptions) {
+	fs.DurationVar(&options.Latency, "latency", 0, "delay of every acknowledgement (e.g., 20ms)")
+	fs.Float64Var(&options.DropRate, "dropRate", 0, "fraction of publishes which are never acknowledged, 0-1")
+	fs.Float64Var(&options.DisconnectRate, "disconnectRate", 0, "fraction of publishes which close the connection, 0-1")
+	fs.Float64Var(&options.RefuseRate, "refuseRate", 0, "fraction of clients whose connections are refused, 0-1")
+	fs.IntVar(&options.DisconnectAfter, "disconnectAfter", 0, "close a connection when it publishes more than this many messages. 0 means never")
+	fs.IntVar(&options.Bandwidth, "bandwidth", 0, "bytes per second a connection may send. 0 means unlimited")
+	fs.Float64Var(&options.DuplicateRate, "duplicateRate", 0, "fraction of publishes which are saved twice, 0-1")
+	fs.Float64Var(&options.ReorderRate, "reorderRate", 0, "fraction of publishes which are saved after the next one of the connection, 0-1")
+}
+
+//printStats prints the counters of b every interval, whenever they changed, until ctx is done
+func (b *FakeBroker) printStats(ctx context.Context, w io.Writer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	last := start
+	var prev FakeBrokerStats
+	for {
+		select {
+		case now := <-ticker.C:
+			stats := b.Stats()
+			if stats == prev {
+				continue
+			}
+			fmt.Fprintf(w, "[%5.0fs] connections: %d  refused: %d  published: %d  rate: %.0f msg/sec  dropped: %d  disconnected: %d  duplicated: %d  reordered: %d\n",
+				now.Sub(start).Seconds(), stats.Connections, stats.Refused, stats.Published,
+				float64(stats.Published-prev.Published)/now.Sub(last).Seconds(), stats.Dropped, stats.Disconnected, stats.Duplicated, stats.Reordered)
+			prev = stats
+			last = now
+		case <-ctx.Done():
+			return
+		}
+	}
+}
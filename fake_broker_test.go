@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//startFakeBroker starts a FakeBroker accepting the tokens of devices, it is closed when the test ends
+func startFakeBroker(t *testing.T, options FakeBrokerOptions, devices ...*Device) *FakeBroker {
+	broker, err := NewFakeBroker("127.0.0.1:0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+
+	broker.AllowTokens(devices)
+	return broker
+}
+
+//connectFakeBroker connects a client with token to broker, it is disconnected when the test ends
+func connectFakeBroker(t *testing.T, broker *FakeBroker, token string) *MqttClient {
+	client := NewMqttClient(token, token, "", broker.URL())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.ConnectAndWait(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+func TestFakeBroker_Connect(t *testing.T) {
+	broker := startFakeBroker(t, FakeBrokerOptions{}, &Device{Name: "device_0", AuthToken: "token-0"})
+	connectFakeBroker(t, broker, "token-0")
+
+	client := NewMqttClient("wrong", "wrong", "", broker.URL())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if connected, err := client.ConnectAndWait(ctx, 0); connected || err == nil {
+		t.Fatal("expected a wrong token to be refused")
+	}
+
+	//paho retries a refused connection with mqtt 3.1
+	if stats := broker.Stats(); stats.Connects != 1 || stats.Refused == 0 || stats.Connections != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFakeBroker_Publish(t *testing.T) {
+	var mu sync.Mutex
+	var published []string
+	broker := startFakeBroker(t, FakeBrokerOptions{}, &Device{Name: "device_0", AuthToken: "token-0"})
+	broker.OnPublish = func(token, topic string, payload []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, token+" "+topic+" "+string(payload))
+	}
+	client := connectFakeBroker(t, broker, "token-0")
+
+	for qos := byte(0); qos <= 2; qos++ {
+		token := client.Publish(tbPubTopic, qos, false, "{}")
+		if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Fatalf("qos %d publish failed: %v", qos, token.Error())
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(published) != 3 || published[0] != "token-0 "+tbPubTopic+" {}" {
+		t.Fatalf("unexpected messages %v", published)
+	}
+
+	if stats := broker.Stats(); stats.Published != 3 || stats.Acked != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFakeBroker_Subscribe(t *testing.T) {
+	broker := startFakeBroker(t, FakeBrokerOptions{}, &Device{Name: "device_0", AuthToken: "token-0"}, &Device{Name: "device_1", AuthToken: "token-1"})
+	subscriber := connectFakeBroker(t, broker, "token-0")
+	publisher := connectFakeBroker(t, broker, "token-1")
+
+	received := make(chan mqtt.Message, 1)
+	token := subscriber.Subscribe("sensors/+/telemetry", 1, func(client mqtt.Client, message mqtt.Message) {
+		received <- message
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+
+	publisher.Publish("sensors/other/attributes", 1, false, "ignored").WaitTimeout(5 * time.Second)
+	publisher.Publish("sensors/s1/telemetry", 2, false, "hello").WaitTimeout(5 * time.Second)
+
+	select {
+	case message := <-received:
+		if message.Topic() != "sensors/s1/telemetry" || string(message.Payload()) != "hello" || message.Qos() != 1 {
+			t.Fatalf("unexpected message %s %s qos %d", message.Topic(), message.Payload(), message.Qos())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestFakeBroker_Faults(t *testing.T) {
+	device := &Device{Name: "device_0", AuthToken: "token-0"}
+
+	broker := startFakeBroker(t, FakeBrokerOptions{Latency: 100 * time.Millisecond}, device)
+	client := connectFakeBroker(t, broker, device.AuthToken)
+	start := time.Now()
+	if _, err := client.PublishAndWait(context.Background(), tbPubTopic, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("acknowledged after %s, expected the latency", elapsed)
+	}
+
+	broker = startFakeBroker(t, FakeBrokerOptions{DropRate: 1}, device)
+	client = connectFakeBroker(t, broker, device.AuthToken)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if published, _ := client.PublishAndWait(ctx, tbPubTopic, "{}"); published {
+		t.Fatal("expected the publish to be dropped")
+	}
+	if stats := broker.Stats(); stats.Dropped != 1 || stats.Acked != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	broker = startFakeBroker(t, FakeBrokerOptions{DisconnectRate: 1}, device)
+	client = connectFakeBroker(t, broker, device.AuthToken)
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if published, _ := client.PublishAndWait(ctx, tbPubTopic, "{}"); published {
+		t.Fatal("expected the publish to fail with the connection")
+	}
+	for broker.Stats().Connects < 2 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := broker.Stats(); stats.Disconnected == 0 || stats.Acked != 0 || stats.Connects < 2 {
+		t.Fatalf("expected a disconnect and a reconnect, got %+v", stats)
+	}
+}
+
+//TestFakeBroker_FaultScenarios publishes through a broker with each fault and checks how the run reports it
+func TestFakeBroker_FaultScenarios(t *testing.T) {
+	const messageNum = 10
+	scenarios := []struct {
+		name      string
+		options   FakeBrokerOptions
+		event     string
+		published int
+	}{
+		{"healthy", FakeBrokerOptions{}, PublishCompleteEvent, messageNum},
+		{"delayed puback", FakeBrokerOptions{Latency: 400 * time.Millisecond}, TimeoutExceededEvent, 2},
+		{"throttled", FakeBrokerOptions{Bandwidth: 100}, TimeoutExceededEvent, -1},
+		{"disconnect after 3", FakeBrokerOptions{DisconnectAfter: 3}, PublishFailEvent, 3},
+		{"refused", FakeBrokerOptions{RefuseRate: 1}, ConnectFailedEvent, 0},
+	}
+
+	opts := publishOptions{topic: tbPubTopic, messageNum: messageNum, encoder: jsonPayload{}, stderr: ioutil.Discard}
+	results := make([]Result, 0, len(scenarios))
+	for _, scenario := range scenarios {
+		device := &Device{Name: "device_0", AuthToken: "token-0"}
+		broker := startFakeBroker(t, scenario.options, device)
+		client := NewMqttClient(device.Name, device.AuthToken, "", broker.URL())
+
+		var result Result
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if connected, _ := client.ConnectAndWait(ctx, 0); connected {
+			result = publishMessages(ctx, client, opts, &RunStats{})
+			client.Disconnect(0)
+		} else {
+			result = Result{ClientId: client.Id, Event: ConnectFailedEvent, Error: true}
+		}
+		cancel()
+
+		if result.Event != scenario.event {
+			t.Errorf("%s: expected %s, got %+v", scenario.name, scenario.event, result)
+		} else if scenario.published >= 0 && result.MessagePublished != scenario.published {
+			t.Errorf("%s: expected %d messages published, got %d", scenario.name, scenario.published, result.MessagePublished)
+		}
+		results = append(results, result)
+	}
+
+	summary, err := buildSummary(len(scenarios), messageNum, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Completed != 1 || summary.Errors != 4 || summary.ConnectFailed != 1 || summary.PublishFailed != 1 || summary.TimeoutExceeded != 2 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestFakeBroker_Refuse(t *testing.T) {
+	devices := make([]*Device, 4)
+	for i := range devices {
+		devices[i] = &Device{Name: fmt.Sprintf("device_%d", i), AuthToken: fmt.Sprintf("token-%d", i)}
+	}
+	broker := startFakeBroker(t, FakeBrokerOptions{RefuseRate: 0.5}, devices...)
+
+	//a refused client stays refused, however often it retries
+	var refused int
+	for i := 0; i < 2; i++ {
+		for _, device := range devices {
+			client := NewMqttClient(device.Name, device.AuthToken, "", broker.URL())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if connected, _ := client.ConnectAndWait(ctx, 0); connected {
+				client.Disconnect(0)
+			} else {
+				refused++
+			}
+			cancel()
+		}
+	}
+
+	if refused != 4 {
+		t.Fatalf("expected half of the connections refused, got %d of 8", refused)
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		matches       bool
+	}{
+		{tbPubTopic, tbPubTopic, true},
+		{tbPubTopic, tbAttributesTopic, false},
+		{"sensors/+/telemetry", "sensors/s1/telemetry", true},
+		{"sensors/+/telemetry", "sensors/s1/s2/telemetry", false},
+		{"sensors/#", "sensors/s1/telemetry", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/s1", "sensors/s1/telemetry", false},
+	}
+
+	for _, c := range cases {
+		if matches := topicMatches(c.filter, c.topic); matches != c.matches {
+			t.Errorf("%s matches %s: expected %v, got %v", c.filter, c.topic, c.matches, matches)
+		}
+	}
+}
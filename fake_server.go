@@ -0,0 +1,991 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	FakeUsername = "tenant@thingsboard.org"
+	FakePassword = "tenant"
+
+	fakeTokenTTL       = 2 * time.Hour
+	fakeDefaultProfile = "default"
+	deviceApiPrefix    = "/api/v1/"
+	wsTelemetryPath    = "/api/ws/plugins/telemetry"
+	telemetryPrefix    = "/api/plugins/telemetry/DEVICE/"
+)
+
+//FakeServer is an in-process thingsboard serving the rest api used by tbload, the device http api to post
+//telemetry and websocket telemetry subscriptions. Everything is kept in memory.
+type FakeServer struct {
+	*httptest.Server
+
+	Username string
+	Password string
+
+	mu            sync.Mutex
+	tokens        map[string]bool //issued jwts
+	refreshTokens map[string]bool //issued refresh tokens
+	devices       map[string]*fakeDevice
+	names         map[string]string //device name to id
+	credentials   map[string]string //access token to device id
+	profiles      map[string]*DeviceProfile
+	subscriptions map[*fakeSubscriber]bool
+}
+
+//fakeDevice is a device of FakeServer with its telemetry sorted by ts
+type fakeDevice struct {
+	TBDevice
+	token      string
+	telemetry  map[string][]TsValue
+	attributes map[string]AttributeValue
+}
+
+//fakeSubscriber is a websocket session of FakeServer, cmds maps a subscribed device id to its subscriptions
+type fakeSubscriber struct {
+	conn *websocket.Conn
+	mu   sync.Mutex //serializes writes to conn
+	cmds map[string][]TsSubCmd
+}
+
+//NewFakeServer starts a FakeServer on a loopback port, a tenant logs in with username and password.
+//The caller should call Close when finished.
+func NewFakeServer(username, password string) *FakeServer {
+	s := newFakeServer(username, password)
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+func newFakeServer(username, password string) *FakeServer {
+	s := &FakeServer{
+		Username:      username,
+		Password:      password,
+		tokens:        make(map[string]bool),
+		refreshTokens: make(map[string]bool),
+		devices:       make(map[string]*fakeDevice),
+		names:         make(map[string]string),
+		credentials:   make(map[string]string),
+		profiles:      make(map[string]*DeviceProfile),
+		subscriptions: make(map[*fakeSubscriber]bool),
+	}
+
+	//every tenant has a default device profile
+	profile := NewDeviceProfile(fakeDefaultProfile, ProfileInfo{
+		TelemetryTopic:  tbPubTopic,
+		AttributesTopic: tbAttributesTopic,
+		PayloadType:     PayloadTypeJson,
+		ProvisionType:   ProvisionDisabled,
+	}, nil, "")
+	profile.Id = &EntityId{Id: fakeUUID(), EntityType: entityTypeDeviceProfile}
+	s.profiles[profile.Id.Id] = profile
+	return s
+}
+
+func (s *FakeServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(loginEnding, s.handleLogin)
+	mux.HandleFunc(refreshTokenEnding, s.handleRefreshToken)
+	mux.Handle(saveDeviceEnding, s.authorized(s.handleSaveDevice))
+	mux.Handle(deleteDeviceEnding, s.authorized(s.handleDevice))
+	mux.Handle("/api/tenant/devices", s.authorized(s.handleTenantDevices))
+	mux.Handle("/api/deviceProfileInfos", s.authorized(s.handleDeviceProfileInfos))
+	mux.Handle(saveDeviceProfileEnding, s.authorized(s.handleSaveDeviceProfile))
+	mux.Handle(deleteDeviceProfileEnding, s.authorized(s.handleDeleteDeviceProfile))
+	mux.Handle(telemetryPrefix, s.authorized(s.handleTelemetry))
+	mux.HandleFunc(deviceApiPrefix, s.handleDeviceApi)
+	mux.Handle(wsTelemetryPath, websocket.Server{Handler: s.handleWebsocket, Handshake: s.handshake})
+	return mux
+}
+
+//writeJson writes v as the json response
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", applicationJson)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+//writeAPIError writes a thingsboard error response
+func writeAPIError(w http.ResponseWriter, statusCode, errorCode int, message string) {
+	w.Header().Set("Content-Type", applicationJson)
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(APIError{Status: statusCode, Message: message, ErrorCode: errorCode})
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	writeAPIError(w, http.StatusNotFound, ErrorCodeItemNotFound, "Requested item wasn't found!")
+}
+
+//fakeUUID returns a random id formatted like a thingsboard uuid
+func fakeUUID() string {
+	h := randomHex(16)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+//newToken returns an unsigned jwt which expires after fakeTokenTTL, s.mu must be held
+func (s *FakeServer) newToken() Token {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS512"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"sub": s.Username,
+		"jti": randomHex(8),
+		"exp": time.Now().Add(fakeTokenTTL).Unix(),
+	})
+	token := Token{
+		Token:        header + "." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln",
+		RefreshToken: randomHex(16),
+	}
+	s.tokens[token.Token] = true
+	s.refreshTokens[token.RefreshToken] = true
+	return token
+}
+
+//validToken reports whether jwt was issued and has not expired
+func (s *FakeServer) validToken(jwt string) bool {
+	s.mu.Lock()
+	issued := s.tokens[jwt]
+	s.mu.Unlock()
+	return issued && time.Now().Before(jwtExpiration(jwt))
+}
+
+func (s *FakeServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var user TenantUser
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&user) != nil {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, "Invalid login request")
+		return
+	}
+
+	if user.Username != s.Username || user.Password != s.Password {
+		writeAPIError(w, http.StatusUnauthorized, ErrorCodeAuthentication, "Invalid username or password")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJson(w, s.newToken())
+}
+
+func (s *FakeServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var request RefreshTokenRequest
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&request) != nil {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, "Invalid refresh token request")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.refreshTokens[request.RefreshToken] {
+		writeAPIError(w, http.StatusUnauthorized, ErrorCodeJwtTokenExpired, "Token has expired")
+		return
+	}
+	writeJson(w, s.newToken())
+}
+
+//authorized rejects requests without a valid X-Authorization header
+func (s *FakeServer) authorized(fn http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwt := strings.TrimPrefix(r.Header.Get("X-Authorization"), "Bearer ")
+		if !s.validToken(jwt) {
+			writeAPIError(w, http.StatusUnauthorized, ErrorCodeJwtTokenExpired, "Token has expired")
+			return
+		}
+		fn(w, r)
+	})
+}
+
+//handleSaveDevice creates a device with an access token
+func (s *FakeServer) handleSaveDevice(w http.ResponseWriter, r *http.Request) {
+	var request SaveDeviceRequest
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&request) != nil {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, "Invalid device")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, err := s.createDevice(request)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, err.Error())
+		return
+	}
+	writeJson(w, device.TBDevice)
+}
+
+//createDevice creates the device of request, s.mu must be held
+func (s *FakeServer) createDevice(request SaveDeviceRequest) (*fakeDevice, error) {
+	if len(request.DeviceName) == 0 {
+		return nil, fmt.Errorf("Device name should be specified!")
+	} else if _, ok := s.names[request.DeviceName]; ok {
+		return nil, fmt.Errorf("Device with such name already exists!")
+	}
+
+	profileId := s.profileId(fakeDefaultProfile)
+	if request.DeviceProfileId != nil {
+		if _, ok := s.profiles[request.DeviceProfileId.Id]; !ok {
+			return nil, fmt.Errorf("Device profile is referencing to non-existent device profile!")
+		}
+		profileId = request.DeviceProfileId.Id
+	}
+
+	deviceType := request.DeviceType
+	if len(deviceType) == 0 {
+		deviceType = s.profiles[profileId].Name
+	}
+
+	device := &fakeDevice{
+		TBDevice: TBDevice{
+			CreatedTime:     time.Now().UnixNano() / int64(time.Millisecond),
+			Id:              EntityId{Id: fakeUUID(), EntityType: entityTypeDevice},
+			Label:           request.Label,
+			Name:            request.DeviceName,
+			Type:            deviceType,
+			DeviceProfileId: EntityId{Id: profileId, EntityType: entityTypeDeviceProfile},
+		},
+		token:      randomHex(10),
+		telemetry:  make(map[string][]TsValue),
+		attributes: make(map[string]AttributeValue),
+	}
+	s.devices[device.Id.Id] = device
+	s.names[device.Name] = device.Id.Id
+	s.credentials[device.token] = device.Id.Id
+	return device, nil
+}
+
+//profileId returns the id of the profile named name, s.mu must be held
+func (s *FakeServer) profileId(name string) string {
+	for id, profile := range s.profiles {
+		if profile.Name == name {
+			return id
+		}
+	}
+	return ""
+}
+
+//handleDevice serves DELETE /api/device/{id} and GET /api/device/{id}/credentials
+func (s *FakeServer) handleDevice(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, deleteDeviceEnding)
+	id := strings.TrimSuffix(path, "/credentials")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.devices[id]
+	if !ok {
+		writeNotFound(w)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodDelete && id == path:
+		delete(s.devices, id)
+		delete(s.names, device.Name)
+		delete(s.credentials, device.token)
+	case r.Method == http.MethodGet && id != path:
+		writeJson(w, Credential{
+			Id:              EntityId{Id: device.Id.Id},
+			CreatedTime:     device.CreatedTime,
+			DeviceId:        device.Id,
+			CredentialsType: "ACCESS_TOKEN",
+			CredentialsId:   device.token,
+		})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, ErrorCodeGeneral, "Request method not supported")
+	}
+}
+
+//handleTenantDevices serves a device by ?deviceName or a page of devices by ?textSearch
+func (s *FakeServer) handleTenantDevices(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name := query.Get("deviceName"); len(name) > 0 {
+		id, ok := s.names[name]
+		if !ok {
+			writeNotFound(w)
+			return
+		}
+		writeJson(w, s.devices[id].TBDevice)
+		return
+	}
+
+	var infos []TenantDeviceInfo
+	for _, device := range s.devices {
+		if hasPrefixFold(device.Name, query.Get("textSearch")) {
+			infos = append(infos, TenantDeviceInfo{Id: device.Id, Name: device.Name, Type: device.Type})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	start, end, totalPages, ok := pageRange(w, query, len(infos))
+	if !ok {
+		return
+	}
+	writeJson(w, TBDevicePage{
+		Data:          append([]TenantDeviceInfo{}, infos[start:end]...),
+		TotalPages:    totalPages,
+		TotalElements: len(infos),
+		HasNext:       end < len(infos),
+	})
+}
+
+//handleDeviceProfileInfos serves a page of device profiles by ?textSearch
+func (s *FakeServer) handleDeviceProfileInfos(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var infos []DeviceProfileInfo
+	for _, profile := range s.profiles {
+		if hasPrefixFold(profile.Name, query.Get("textSearch")) {
+			infos = append(infos, DeviceProfileInfo{Id: *profile.Id, Name: profile.Name, Type: profile.Type})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	start, end, _, ok := pageRange(w, query, len(infos))
+	if !ok {
+		return
+	}
+	writeJson(w, DeviceProfileInfoPage{Data: append([]DeviceProfileInfo{}, infos[start:end]...), HasNext: end < len(infos)})
+}
+
+//hasPrefixFold is the text search of thingsboard, a case insensitive prefix match
+func hasPrefixFold(s, prefix string) bool {
+	return strings.HasPrefix(strings.ToLower(s), strings.ToLower(prefix))
+}
+
+//pageRange returns the range of items of ?pageSize and ?page, a bad request is written if they are invalid
+func pageRange(w http.ResponseWriter, query neturl.Values, items int) (start, end, totalPages int, ok bool) {
+	pageSize, err := strconv.Atoi(query.Get("pageSize"))
+	if err != nil || pageSize < 1 {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, "Invalid page size")
+		return 0, 0, 0, false
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 0 {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, "Invalid page")
+		return 0, 0, 0, false
+	}
+
+	start = page * pageSize
+	if start > items {
+		start = items
+	}
+	end = start + pageSize
+	if end > items {
+		end = items
+	}
+	return start, end, (items + pageSize - 1) / pageSize, true
+}
+
+//handleSaveDeviceProfile creates a device profile, or updates it if the id is set
+func (s *FakeServer) handleSaveDeviceProfile(w http.ResponseWriter, r *http.Request) {
+	var profile DeviceProfile
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&profile) != nil || len(profile.Name) == 0 {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, "Device profile name should be specified!")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if profile.Id != nil {
+		if _, ok := s.profiles[profile.Id.Id]; !ok {
+			writeNotFound(w)
+			return
+		}
+	} else {
+		profile.Id = &EntityId{Id: fakeUUID(), EntityType: entityTypeDeviceProfile}
+	}
+
+	if id := s.profileId(profile.Name); len(id) > 0 && id != profile.Id.Id {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, "Device profile with such name already exists!")
+		return
+	}
+
+	s.profiles[profile.Id.Id] = &profile
+	writeJson(w, profile)
+}
+
+//handleDeleteDeviceProfile deletes a device profile which no device refers to
+func (s *FakeServer) handleDeleteDeviceProfile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, deleteDeviceProfileEnding)
+	if r.Method != http.MethodDelete {
+		writeAPIError(w, http.StatusMethodNotAllowed, ErrorCodeGeneral, "Request method not supported")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.profiles[id]; !ok {
+		writeNotFound(w)
+		return
+	}
+
+	for _, device := range s.devices {
+		if device.DeviceProfileId.Id == id {
+			writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, "The device profile referenced by the devices cannot be deleted!")
+			return
+		}
+	}
+	delete(s.profiles, id)
+}
+
+//handleTelemetry serves /api/plugins/telemetry/DEVICE/{id}/values/timeseries and .../values/attributes
+func (s *FakeServer) handleTelemetry(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, telemetryPrefix), "/")
+	if len(parts) != 3 || parts[1] != "values" || r.Method != http.MethodGet {
+		writeNotFound(w)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.devices[parts[0]]
+	if !ok {
+		writeNotFound(w)
+		return
+	}
+
+	query := r.URL.Query()
+	switch parts[2] {
+	case "attributes":
+		attributes := make([]AttributeValue, 0, len(device.attributes))
+		for _, attribute := range device.attributes {
+			attributes = append(attributes, attribute)
+		}
+		sort.Slice(attributes, func(i, j int) bool {
+			return attributes[i].Key < attributes[j].Key
+		})
+		writeJson(w, attributes)
+	case "timeseries":
+		var keys []string
+		if len(query.Get("keys")) > 0 {
+			keys = strings.Split(query.Get("keys"), ",")
+		} else {
+			for key := range device.telemetry {
+				keys = append(keys, key)
+			}
+		}
+
+		if len(query.Get("startTs")) == 0 {
+			writeJson(w, device.latest(keys))
+			return
+		}
+
+		series, err := device.timeseries(keys, query)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, err.Error())
+			return
+		}
+		writeJson(w, series)
+	default:
+		writeNotFound(w)
+	}
+}
+
+//latest returns the latest point of every key which has any
+func (d *fakeDevice) latest(keys []string) map[string][]TsValue {
+	series := make(map[string][]TsValue)
+	for _, key := range keys {
+		if points := d.telemetry[key]; len(points) > 0 {
+			series[key] = []TsValue{points[len(points)-1]}
+		}
+	}
+	return series
+}
+
+//timeseries returns the points of keys between ?startTs and ?endTs, aggregated by ?agg over ?interval
+func (d *fakeDevice) timeseries(keys []string, query neturl.Values) (map[string][]TsValue, error) {
+	get := func(key, defaultValue string) string {
+		if value := query.Get(key); len(value) > 0 {
+			return value
+		}
+		return defaultValue
+	}
+
+	startTs, err := strconv.ParseInt(get("startTs", ""), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid startTs")
+	}
+	endTs, err := strconv.ParseInt(get("endTs", ""), 10, 64)
+	if err != nil || endTs < startTs {
+		return nil, fmt.Errorf("Invalid endTs")
+	}
+	limit, err := strconv.Atoi(get("limit", "100"))
+	if err != nil || limit < 1 {
+		return nil, fmt.Errorf("Invalid limit")
+	}
+	agg := strings.ToUpper(get("agg", "NONE"))
+	interval, err := strconv.ParseInt(get("interval", "0"), 10, 64)
+	if err != nil || (agg != "NONE" && interval < 1) {
+		return nil, fmt.Errorf("Invalid interval")
+	}
+
+	series := make(map[string][]TsValue)
+	for _, key := range keys {
+		points := d.telemetry[key]
+		from := sort.Search(len(points), func(i int) bool { return points[i].Ts >= startTs })
+		to := sort.Search(len(points), func(i int) bool { return points[i].Ts > endTs })
+
+		var result []TsValue
+		if agg == "NONE" {
+			result = append(result, points[from:to]...)
+			if get("orderBy", "DESC") == "DESC" {
+				for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+					result[i], result[j] = result[j], result[i]
+				}
+			}
+		} else if result, err = aggregate(points[from:to], startTs, interval, agg); err != nil {
+			return nil, err
+		}
+
+		if len(result) > limit {
+			result = result[:limit]
+		}
+		if len(result) > 0 {
+			series[key] = result
+		}
+	}
+	return series, nil
+}
+
+//aggregate aggregates numeric points into intervals from startTs, a result is stamped with the middle of its interval
+func aggregate(points []TsValue, startTs, interval int64, agg string) ([]TsValue, error) {
+	var result []TsValue
+	for i := 0; i < len(points); {
+		bucket := startTs + (points[i].Ts-startTs)/interval*interval
+		var count int
+		var sum, min, max float64
+		for ; i < len(points) && points[i].Ts < bucket+interval; i++ {
+			value, err := strconv.ParseFloat(fmt.Sprint(points[i].Value), 64)
+			if err != nil {
+				continue
+			}
+			if count == 0 || value < min {
+				min = value
+			}
+			if count == 0 || value > max {
+				max = value
+			}
+			sum += value
+			count++
+		}
+		if count == 0 {
+			continue
+		}
+
+		var value float64
+		switch agg {
+		case "AVG":
+			value = sum / float64(count)
+		case "MIN":
+			value = min
+		case "MAX":
+			value = max
+		case "SUM":
+			value = sum
+		case "COUNT":
+			value = float64(count)
+		default:
+			return nil, fmt.Errorf("Invalid aggregation %s", agg)
+		}
+		result = append(result, TsValue{Ts: bucket + interval/2, Value: strconv.FormatFloat(value, 'f', -1, 64)})
+	}
+	return result, nil
+}
+
+//handleDeviceApi serves POST /api/v1/{token}/telemetry and /api/v1/{token}/attributes of the device http api
+func (s *FakeServer) handleDeviceApi(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, deviceApiPrefix), "/")
+	if len(parts) != 2 || r.Method != http.MethodPost {
+		writeNotFound(w)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, err.Error())
+		return
+	}
+
+	switch parts[1] {
+	case "telemetry":
+		err = s.SaveTelemetry(parts[0], payload)
+	case "attributes":
+		err = s.SaveAttributes(parts[0], payload)
+	default:
+		writeNotFound(w)
+		return
+	}
+
+	if err == ErrDeviceNotExist {
+		writeAPIError(w, http.StatusUnauthorized, ErrorCodeAuthentication, "Invalid access token")
+	} else if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ErrorCodeBadRequestParams, err.Error())
+	}
+}
+
+//Authenticate returns the name of the device with the access token, ErrDeviceNotExist if there is none
+func (s *FakeServer) Authenticate(token string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.credentials[token]
+	if !ok {
+		return "", ErrDeviceNotExist
+	}
+	return s.devices[id].Name, nil
+}
+
+//HandlePublish saves a message published over mqtt by the device with the access token to the telemetry or
+//attributes topic of its profile, like the mqtt transport of thingsboard. Payloads which are not json are dropped.
+func (s *FakeServer) HandlePublish(token, topic string, payload []byte) {
+	telemetryTopic, attributesTopic := tbPubTopic, tbAttributesTopic
+	s.mu.Lock()
+	if id, ok := s.credentials[token]; ok {
+		if profile, ok := s.profiles[s.devices[id].DeviceProfileId.Id]; ok {
+			config := profile.ProfileData.TransportConfiguration
+			if len(config.DeviceTelemetryTopic) > 0 {
+				telemetryTopic = config.DeviceTelemetryTopic
+			}
+			if len(config.DeviceAttributesTopic) > 0 {
+				attributesTopic = config.DeviceAttributesTopic
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if topicMatches(telemetryTopic, topic) {
+		_ = s.SaveTelemetry(token, payload)
+	} else if topicMatches(attributesTopic, topic) {
+		_ = s.SaveAttributes(token, payload)
+	}
+}
+
+//SaveTelemetry saves a thingsboard json telemetry payload of the device with the access token:
+//{"key":value}, {"ts":ts,"values":{"key":value}} or an array of them
+func (s *FakeServer) SaveTelemetry(token string, payload []byte) error {
+	//like thingsboard, a payload without ts overwrites the one saved in the same millisecond
+	entries, err := parseTelemetry(payload, time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	id, ok := s.credentials[token]
+	if !ok {
+		s.mu.Unlock()
+		return ErrDeviceNotExist
+	}
+
+	device := s.devices[id]
+	updates := make(map[string][]TsValue)
+	for _, entry := range entries {
+		for key, value := range entry.Values {
+			point := TsValue{Ts: entry.Ts, Value: value}
+			device.telemetry[key] = insertPoint(device.telemetry[key], point)
+			updates[key] = append(updates[key], point)
+		}
+	}
+
+	var subscribers []*fakeSubscriber
+	for subscriber := range s.subscriptions {
+		if len(subscriber.cmds[id]) > 0 {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.notify(id, updates)
+	}
+	return nil
+}
+
+//SaveAttributes saves a json object of client attributes of the device with the access token
+func (s *FakeServer) SaveAttributes(token string, payload []byte) error {
+	values, err := decodeValues(payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.credentials[token]
+	if !ok {
+		return ErrDeviceNotExist
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for key, value := range values {
+		s.devices[id].attributes[key] = AttributeValue{LastUpdateTs: now, Key: key, Value: value}
+	}
+	return nil
+}
+
+//insertPoint inserts point into points sorted by ts, a point with the same ts is overwritten
+func insertPoint(points []TsValue, point TsValue) []TsValue {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Ts >= point.Ts })
+	if i < len(points) && points[i].Ts == point.Ts {
+		points[i] = point
+		return points
+	}
+
+	points = append(points, TsValue{})
+	copy(points[i+1:], points[i:])
+	points[i] = point
+	return points
+}
+
+//telemetryEntry is a timestamped set of values of a telemetry payload
+type telemetryEntry struct {
+	Ts     int64
+	Values map[string]string
+}
+
+//parseTelemetry parses a thingsboard json telemetry payload, values are kept as strings like thingsboard returns them.
+//Values without ts are saved at now.
+func parseTelemetry(payload []byte, now int64) ([]telemetryEntry, error) {
+	var raws []json.RawMessage
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, err
+		}
+	} else {
+		raws = []json.RawMessage{payload}
+	}
+
+	entries := make([]telemetryEntry, 0, len(raws))
+	for _, raw := range raws {
+		var timestamped struct {
+			Ts     *json.Number    `json:"ts"`
+			Values json.RawMessage `json:"values"`
+		}
+		if err := json.Unmarshal(raw, &timestamped); err != nil {
+			return nil, err
+		}
+
+		entry := telemetryEntry{Ts: now}
+		var err error
+		if timestamped.Ts != nil && len(timestamped.Values) > 0 {
+			if entry.Ts, err = timestamped.Ts.Int64(); err != nil {
+				return nil, err
+			}
+			entry.Values, err = decodeValues(timestamped.Values)
+		} else {
+			entry.Values, err = decodeValues(raw)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+//decodeValues decodes a json object of key values, numbers keep their exact text
+func decodeValues(data []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(object))
+	for key, value := range object {
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case json.Number, bool:
+			values[key] = fmt.Sprint(v)
+		default:
+			encoded, _ := json.Marshal(v)
+			values[key] = string(encoded)
+		}
+	}
+	return values, nil
+}
+
+//handshake accepts websocket sessions opened with a valid jwt in ?token
+func (s *FakeServer) handshake(config *websocket.Config, r *http.Request) error {
+	if !s.validToken(r.URL.Query().Get("token")) {
+		return fmt.Errorf("invalid token")
+	}
+	return nil
+}
+
+//handleWebsocket registers the subscriptions of a session, every subscription gets the latest values first
+func (s *FakeServer) handleWebsocket(conn *websocket.Conn) {
+	subscriber := &fakeSubscriber{conn: conn, cmds: make(map[string][]TsSubCmd)}
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscriptions, subscriber)
+		s.mu.Unlock()
+	}()
+
+	for {
+		var cmds TelemetryPluginCmds
+		if err := websocket.JSON.Receive(conn, &cmds); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		var initial []SubscriptionUpdate
+		for _, cmd := range cmds.TsSubCmds {
+			device, ok := s.devices[cmd.EntityId]
+			if !ok {
+				initial = append(initial, SubscriptionUpdate{SubscriptionId: cmd.CmdId, ErrorCode: ErrorCodeItemNotFound, ErrorMsg: "Device not found"})
+				continue
+			}
+
+			subscriber.mu.Lock()
+			subscriber.cmds[cmd.EntityId] = append(subscriber.cmds[cmd.EntityId], cmd)
+			subscriber.mu.Unlock()
+			initial = append(initial, SubscriptionUpdate{SubscriptionId: cmd.CmdId, Data: subscriptionData(device.latest(strings.Split(cmd.Keys, ",")))})
+		}
+		s.subscriptions[subscriber] = true
+		s.mu.Unlock()
+
+		for _, update := range initial {
+			subscriber.send(update)
+		}
+	}
+}
+
+//notify sends the updated points of device id to the subscriptions of the session which contain their keys
+func (sub *fakeSubscriber) notify(id string, updates map[string][]TsValue) {
+	sub.mu.Lock()
+	cmds := sub.cmds[id]
+	sub.mu.Unlock()
+
+	for _, cmd := range cmds {
+		series := make(map[string][]TsValue)
+		for _, key := range strings.Split(cmd.Keys, ",") {
+			if points, ok := updates[key]; ok {
+				series[key] = points
+			}
+		}
+		if len(series) > 0 {
+			sub.send(SubscriptionUpdate{SubscriptionId: cmd.CmdId, Data: subscriptionData(series)})
+		}
+	}
+}
+
+func (sub *fakeSubscriber) send(update SubscriptionUpdate) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	_ = websocket.JSON.Send(sub.conn, update)
+}
+
+//subscriptionData converts points to the [ts, value] pairs of SubscriptionUpdate
+func subscriptionData(series map[string][]TsValue) map[string][][]interface{} {
+	data := make(map[string][][]interface{}, len(series))
+	for key, points := range series {
+		for _, point := range points {
+			data[key] = append(data[key], []interface{}{point.Ts, point.Value})
+		}
+	}
+	return data
+}
+
+//device returns the device named name, for tests
+func (s *FakeServer) device(name string) (fakeDevice, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.names[name]
+	if !ok {
+		return fakeDevice{}, false
+	}
+	return *s.devices[id], true
+}
+
+type FakeServerCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	addr     string
+	username string
+	password string
+	mqttAddr string
+	options  FakeBrokerOptions
+}
+
+func newFakeServerCommand(m *Main) *FakeServerCommand {
+	return &FakeServerCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *FakeServerCommand) Run(ctx context.Context, args ...string) error {
+	fs := flag.NewFlagSet("fake-server", flag.ContinueOnError)
+
+	help := fs.Bool("h", false, "print this screen")
+	fs.StringVar(&cmd.addr, "addr", "127.0.0.1:8080", "address to listen on")
+	fs.StringVar(&cmd.username, "username", FakeUsername, "name of the tenant user")
+	fs.StringVar(&cmd.password, "password", FakePassword, "password of the tenant user")
+	fs.StringVar(&cmd.mqttAddr, "mqttAddr", "", "also run a fake mqtt broker on this address which saves the published telemetry (e.g., 127.0.0.1:1883)")
+	addFakeBrokerFlags(fs, &cmd.options)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	} else if *help {
+		fs.Usage()
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", cmd.addr)
+	if err != nil {
+		return err
+	}
+
+	s := newFakeServer(cmd.username, cmd.password)
+	s.Server = &httptest.Server{Listener: listener, Config: &http.Server{Handler: s.handler()}}
+	s.Start()
+	defer s.Close()
+
+	fmt.Fprintf(cmd.Stdout, "fake thingsboard listening on %s, stop with ctrl-c\n", s.URL)
+	fmt.Fprintf(cmd.Stdout, "tbload init -serverHost %s -username %s -password %s\n", s.URL, s.Username, s.Password)
+
+	ctx, cancel := notifyContext(ctx)
+	defer cancel()
+	if len(cmd.mqttAddr) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	broker, err := NewFakeBroker(cmd.mqttAddr, cmd.options)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = broker.Close() }()
+	broker.Authenticate = s.Authenticate
+	broker.OnPublish = s.HandlePublish
+
+	fmt.Fprintf(cmd.Stdout, "tbload run -brokerUrl %s\n", broker.URL())
+	broker.printStats(ctx, cmd.Stdout, progressInterval)
+	return nil
+}
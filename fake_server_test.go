@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFakeServer_Telemetry(t *testing.T) {
+	server, user := loginFakeServer(t)
+	defer server.Close()
+	ctx := context.Background()
+
+	device := &Device{Name: "device_0", Type: "default"}
+	if err := user.CreateDevice(ctx, device); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := user.GetDeviceAuthToken(ctx, device.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//telemetry is posted like devices do over http, the point at ts 2 is overwritten
+	payloads := []string{
+		`{"ts":1,"values":{"temperature":10,"seq":0}}`,
+		`[{"ts":2,"values":{"temperature":99}},{"ts":3,"values":{"temperature":30,"seq":2}}]`,
+		`{"ts":2,"values":{"temperature":20,"seq":1}}`,
+	}
+	for _, payload := range payloads {
+		response, err := http.Post(server.URL+"/api/v1/"+token+"/telemetry", applicationJson, bytes.NewBufferString(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("post %s: %s", payload, response.Status)
+		}
+	}
+
+	if err = server.SaveTelemetry("wrong", []byte(`{"temperature":1}`)); err != ErrDeviceNotExist {
+		t.Fatalf("expected ErrDeviceNotExist, got %v", err)
+	}
+
+	points, err := user.GetTimeseries(ctx, device.Id, "temperature", 1, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(points) != "[{1 10} {2 20} {3 30}]" {
+		t.Fatalf("unexpected points %v", points)
+	}
+
+	latest, err := user.GetLatestTelemetry(ctx, device.Id, "temperature,seq,missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(latest) != "map[seq:[{3 2}] temperature:[{3 30}]]" {
+		t.Fatalf("unexpected latest %v", latest)
+	}
+
+	series, err := user.GetAggregatedTimeseries(ctx, device.Id, "temperature", 0, 3, 2, "AVG", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(series) != "map[temperature:[{1 10} {3 25}]]" {
+		t.Fatalf("unexpected aggregation %v", series)
+	}
+
+	if err = server.SaveAttributes(token, []byte(`{"firmware":"1.0"}`)); err != nil {
+		t.Fatal(err)
+	}
+	attributes, err := user.GetAttributes(ctx, device.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attributes) != 1 || attributes[0].Key != "firmware" || attributes[0].Value != "1.0" {
+		t.Fatalf("unexpected attributes %+v", attributes)
+	}
+}
+
+func TestFakeServer_ListTenantDevices(t *testing.T) {
+	server, user := loginFakeServer(t)
+	defer server.Close()
+	ctx := context.Background()
+
+	for _, name := range []string{"load_0", "load_1", "load_2", "other_0"} {
+		if err := user.CreateDevice(ctx, &Device{Name: name, Type: "default"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := user.ListTenantDevices(ctx, "LOAD", 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Data) != 1 || page.Data[0].Name != "load_2" || page.TotalPages != 2 || page.TotalElements != 3 || page.HasNext {
+		t.Fatalf("unexpected page %+v", page)
+	}
+}
+
+func TestFakeServer_Subscription(t *testing.T) {
+	server, user := loginFakeServer(t)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	device := &Device{Name: "device_0", Type: "default"}
+	if err := user.CreateDevice(ctx, device); err != nil {
+		t.Fatal(err)
+	}
+	created, _ := server.device(device.Name)
+	if err := server.SaveTelemetry(created.token, []byte(`{"ts":1,"values":{"key":1}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	updates := make(chan *SubscriptionUpdate, 10)
+	session, err := OpenTelemetrySession(ctx, user, []string{device.Id}, []string{"key"}, func(update *SubscriptionUpdate) {
+		updates <- update
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	//the latest value is sent first, then every new one
+	expected := []int64{1, 2}
+	for i, ts := range expected {
+		select {
+		case update := <-updates:
+			if point := update.Data["key"]; len(point) != 1 || point[0][0] != float64(ts) {
+				t.Fatalf("unexpected update %+v", update)
+			}
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+
+		if i == 0 {
+			if err = server.SaveTelemetry(created.token, []byte(`{"ts":2,"values":{"key":2,"other":3}}`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
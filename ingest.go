@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	wsTelemetryEnding = "/api/ws/plugins/telemetry?token=%s"
+	wsDialTimeout     = 10 * time.Second
+
+	entityTypeDevice     = "DEVICE"
+	scopeLatestTelemetry = "LATEST_TELEMETRY"
+	ingestPollInterval   = 100 * time.Millisecond
+
+	//how long to wait for messages still on their way to the subscription after publishing ended
+	ingestGrace = 10 * time.Second
+)
+
+//TsSubCmd subscribes to the telemetry of an entity
+type TsSubCmd struct {
+	EntityType string `json:"entityType"`
+	EntityId   string `json:"entityId"`
+	Scope      string `json:"scope"`
+	CmdId      int    `json:"cmdId"`
+	Keys       string `json:"keys"`
+}
+
+//TelemetryPluginCmds correspond to the messages sent to /api/ws/plugins/telemetry
+type TelemetryPluginCmds struct {
+	TsSubCmds   []TsSubCmd    `json:"tsSubCmds"`
+	HistoryCmds []interface{} `json:"historyCmds"`
+	AttrSubCmds []interface{} `json:"attrSubCmds"`
+}
+
+//SubscriptionUpdate correspond to the messages received from /api/ws/plugins/telemetry,
+//data maps a key to [ts, value] pairs
+type SubscriptionUpdate struct {
+	SubscriptionId int                        `json:"subscriptionId"`
+	ErrorCode      int                        `json:"errorCode"`
+	ErrorMsg       string                     `json:"errorMsg"`
+	Data           map[string][][]interface{} `json:"data"`
+}
+
+//TelemetrySession is a websocket session subscribed to the latest telemetry of devices
+type TelemetrySession struct {
+	conn    *websocket.Conn
+	done    chan struct{}
+	closing int32 //set when the session is closed by us rather than the server
+}
+
+//wsUrl returns the websocket url of serverHost
+func wsUrl(serverHost string) string {
+	if strings.HasPrefix(serverHost, "https://") {
+		return "wss://" + strings.TrimPrefix(serverHost, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(serverHost, "http://")
+}
+
+//OpenTelemetrySession opens a websocket session with the jwt of user subscribing to keys of every device in
+//deviceIds. onUpdate is called from a single goroutine with every received update until ctx is done or the
+//session is closed.
+func OpenTelemetrySession(ctx context.Context, user *TenantUser, deviceIds []string, keys []string, onUpdate func(update *SubscriptionUpdate)) (*TelemetrySession, error) {
+	jwt, err := user.authorization(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	//the token is passed without the Bearer scheme of the X-Authorization header
+	token := neturl.QueryEscape(strings.TrimPrefix(jwt, "Bearer "))
+	config, err := websocket.NewConfig(wsUrl(user.ServerHost)+fmt.Sprintf(wsTelemetryEnding, token), user.ServerHost)
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{Timeout: wsDialTimeout}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := TelemetryPluginCmds{HistoryCmds: []interface{}{}, AttrSubCmds: []interface{}{}}
+	for i, id := range deviceIds {
+		cmds.TsSubCmds = append(cmds.TsSubCmds, TsSubCmd{
+			EntityType: entityTypeDevice,
+			EntityId:   id,
+			Scope:      scopeLatestTelemetry,
+			CmdId:      i + 1,
+			Keys:       strings.Join(keys, ","),
+		})
+	}
+
+	if err = websocket.JSON.Send(conn, cmds); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	s := &TelemetrySession{conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for {
+			var update SubscriptionUpdate
+			if err := websocket.JSON.Receive(conn, &update); err != nil {
+				return
+			}
+			onUpdate(&update)
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&s.closing, 1)
+			_ = conn.Close()
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+//Done is closed when the session ends
+func (s *TelemetrySession) Done() <-chan struct{} {
+	return s.done
+}
+
+//Close closes the session and waits for the last update to be handled
+func (s *TelemetrySession) Close() {
+	atomic.StoreInt32(&s.closing, 1)
+	_ = s.conn.Close()
+	<-s.done
+}
+
+//Dropped reports whether the session was ended by the server or the network
+func (s *TelemetrySession) Dropped() bool {
+	select {
+	case <-s.done:
+		return atomic.LoadInt32(&s.closing) == 0
+	default:
+		return false
+	}
+}
+
+//pointValue returns the value of a [ts, value] pair of a SubscriptionUpdate as a number
+func pointValue(point []interface{}) (ts int64, value float64, ok bool) {
+	if len(point) < 2 {
+		return 0, 0, false
+	}
+
+	t, ok := point[0].(float64)
+	if !ok {
+		return 0, 0, false
+	}
+
+	value, err := strconv.ParseFloat(fmt.Sprint(point[1]), 64)
+	return int64(t), value, err == nil
+}
+
+//IngestMonitor subscribes to the send time key of devices and measures how long published messages take to
+//arrive on the subscription, which is what dashboards see.
+type IngestMonitor struct {
+	*TelemetrySession
+	received int64
+}
+
+//StartIngestMonitor subscribes to key of every device in deviceIds.
+//Latencies of messages sent from since are counted in stats until ctx is done or Stop is called, subscription
+//errors are written to stderr.
+func StartIngestMonitor(ctx context.Context, user *TenantUser, deviceIds []string, key string, since time.Time, stats *RunStats, stderr io.Writer) (*IngestMonitor, error) {
+	sinceMs := since.UnixNano() / int64(time.Millisecond)
+	m := &IngestMonitor{}
+
+	session, err := OpenTelemetrySession(ctx, user, deviceIds, []string{key}, func(update *SubscriptionUpdate) {
+		if update.ErrorCode != 0 {
+			fmt.Fprintf(stderr, "subscription[%d] error %d: %s\n", update.SubscriptionId, update.ErrorCode, update.ErrorMsg)
+			return
+		}
+
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		for _, point := range update.Data[key] {
+			//send times before since are left by earlier runs
+			_, sent, ok := pointValue(point)
+			if !ok || int64(sent) < sinceMs {
+				continue
+			}
+
+			atomic.AddInt64(&m.received, 1)
+			stats.Ingested(time.Duration(now-int64(sent)) * time.Millisecond)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.TelemetrySession = session
+	return m, nil
+}
+
+//Received returns the number of messages of this run seen on the subscription
+func (m *IngestMonitor) Received() int {
+	return int(atomic.LoadInt64(&m.received))
+}
+
+//Wait waits until expected messages were received, grace passed or ctx is done
+func (m *IngestMonitor) Wait(ctx context.Context, expected int, grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for m.Received() < expected && time.Now().Before(deadline) && ctx.Err() == nil {
+		select {
+		case <-m.Done():
+			return
+		case <-time.After(ingestPollInterval):
+		}
+	}
+}
+
+//Stop closes the session
+func (m *IngestMonitor) Stop() {
+	m.Close()
+}
+
+//startIngestMonitor subscribes to the send times of the first sample clients, whose devices are in devices by
+//client id. It returns the monitor and the ids of the sampled clients.
+func startIngestMonitor(ctx context.Context, info *InitCommandInfo, devices map[string]*Device, clients []*MqttClient, sample int, format string, since time.Time, stats *RunStats, stderr io.Writer) (*IngestMonitor, map[string]bool, error) {
+	user, err := info.tenantUser(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sample > len(clients) {
+		sample = len(clients)
+	}
+
+	sampled := make(map[string]bool, sample)
+	deviceIds := make([]string, 0, sample)
+	for _, c := range clients[:sample] {
+		//devices provisioned over mqtt are stored without id
+		id, err := deviceId(ctx, user, devices[c.Id])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sampled[c.Id] = true
+		deviceIds = append(deviceIds, id)
+	}
+
+	monitor, err := StartIngestMonitor(ctx, user, deviceIds, sentKey(format), since, stats, stderr)
+	return monitor, sampled, err
+}
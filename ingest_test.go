@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestIngestMonitor(t *testing.T) {
+	since := time.Now()
+	sentMs := since.UnixNano()/int64(time.Millisecond) + 1
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(loginEnding, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+	})
+	mux.Handle("/api/ws/plugins/telemetry", websocket.Handler(func(conn *websocket.Conn) {
+		if token := conn.Request().URL.Query().Get("token"); token != "token" {
+			t.Errorf("unexpected token %s", token)
+		}
+
+		var cmds TelemetryPluginCmds
+		if err := websocket.JSON.Receive(conn, &cmds); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(cmds.TsSubCmds) != 2 || cmds.TsSubCmds[1].EntityId != "device-2" || cmds.TsSubCmds[1].Keys != jsonSentKey {
+			t.Errorf("unexpected subscription %+v", cmds)
+		}
+
+		//the latest value of an earlier run comes first and is ignored, an error is reported
+		updates := []SubscriptionUpdate{
+			{SubscriptionId: 3, ErrorCode: 7, ErrorMsg: "no such device"},
+			{SubscriptionId: 1, Data: map[string][][]interface{}{jsonSentKey: {{1, "1000"}}}},
+			{SubscriptionId: 1, Data: map[string][][]interface{}{jsonSentKey: {{2, strconv.FormatInt(sentMs, 10)}}}},
+			{SubscriptionId: 2, Data: map[string][][]interface{}{jsonSentKey: {{3, strconv.FormatInt(sentMs, 10)}}}},
+		}
+		for _, update := range updates {
+			_ = websocket.JSON.Send(conn, update)
+		}
+
+		var ignored interface{}
+		_ = websocket.JSON.Receive(conn, &ignored)
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := &RunStats{}
+	var stderr bytes.Buffer
+	monitor, err := StartIngestMonitor(context.Background(), user, []string{"device-1", "device-2"}, jsonSentKey, since, stats, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monitor.Wait(context.Background(), 2, 5*time.Second)
+	monitor.Stop()
+
+	if received := monitor.Received(); received != 2 {
+		t.Fatalf("expected 2 messages, got %d", received)
+	}
+	if stderr.String() != "subscription[3] error 7: no such device\n" {
+		t.Fatalf("unexpected errors %q", stderr.String())
+	}
+
+	if _, ingest := stats.Latencies(); ingest.Samples != 2 || ingest.Max > time.Minute {
+		t.Fatalf("unexpected ingest latencies %v", ingest)
+	}
+}
+
+func TestWsUrl(t *testing.T) {
+	if url := wsUrl("https://demo.thingsboard.io"); url != "wss://demo.thingsboard.io" {
+		t.Fatalf("unexpected url %s", url)
+	}
+
+	if url := wsUrl("http://localhost:8080"); url != "ws://localhost:8080" {
+		t.Fatalf("unexpected url %s", url)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	InventoryJson = "json"
+	InventoryCsv  = "csv"
+)
+
+var (
+	//columns of a csv inventory, an imported csv needs name and token, the others may be left out
+	inventoryColumns = []string{"name", "id", "token", "seqNo", "type", "label", "deviceProfileId"}
+)
+
+//Inventory is the init info and the devices of a store, as export writes them
+type Inventory struct {
+	Info    InitCommandInfo `json:"info"`
+	Devices []*Device       `json:"devices"`
+}
+
+type ExportCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	store   StoreFlags
+	file    string
+	format  string
+	secrets bool
+}
+
+func newExportCommand(m *Main) *ExportCommand {
+	return &ExportCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *ExportCommand) Run(ctx context.Context, args ...string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+
+	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
+	fs.StringVar(&cmd.file, "file", "", "file to write the devices to. empty means stdout")
+	fs.StringVar(&cmd.format, "format", "", "json, with the init info, or csv. empty means by the extension of -file, else json")
+	fs.BoolVar(&cmd.secrets, "secrets", false, "export the provision device secret of the profile as well")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	} else if *help {
+		fs.Usage()
+		return nil
+	}
+
+	format, err := inventoryFormat(cmd.format, cmd.file)
+	if err != nil {
+		return err
+	}
+
+	info, devices, err := loadDevices(cmd.store)
+	if err != nil {
+		return err
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].SeqNo < devices[j].SeqNo
+	})
+
+	//the tenant credentials stay on this machine, the importing one gives its own
+	info.Credentials = CredentialsNone
+	info.EncryptedPassword = ""
+	info.RefreshToken = ""
+	if !cmd.secrets {
+		info.Profile.ProvisionDeviceSecret = ""
+	}
+	inventory := Inventory{Info: info, Devices: devices}
+
+	if len(cmd.file) == 0 {
+		return writeInventory(cmd.Stdout, format, inventory)
+	}
+
+	//the access tokens are secrets as well
+	f, err := os.OpenFile(cmd.file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = writeInventory(f, format, inventory); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "%d devices exported to %s\n", len(devices), cmd.file)
+	return nil
+}
+
+type ImportCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	store      StoreFlags
+	file       string
+	format     string
+	serverHost string
+	username   string
+	namePrefix string
+}
+
+func newImportCommand(m *Main) *ImportCommand {
+	return &ImportCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *ImportCommand) Run(ctx context.Context, args ...string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+
+	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
+	fs.StringVar(&cmd.file, "file", "", "json or csv file with the devices, - means stdin")
+	fs.StringVar(&cmd.format, "format", "", "json or csv. empty means by the extension of -file, else json")
+	fs.StringVar(&cmd.serverHost, "serverHost", "", "thingsboard server host of the devices. empty means the exported one")
+	fs.StringVar(&cmd.username, "username", "", "name of thingsboard tenant user. empty means the exported one")
+	fs.StringVar(&cmd.namePrefix, "namePrefix", "", "the devices are stored as prefix_N by their seqNo. empty means the exported one, else "+DeviceNamePrefix)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	} else if *help {
+		fs.Usage()
+		return nil
+	} else if len(cmd.file) == 0 {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	format, err := inventoryFormat(cmd.format, cmd.file)
+	if err != nil {
+		return err
+	}
+
+	r := cmd.Stdin
+	if cmd.file != "-" {
+		f, err := os.Open(cmd.file)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		r = f
+	}
+
+	inventory, err := readInventory(r, format)
+	if err != nil {
+		return fmt.Errorf("%s: %v", cmd.file, err)
+	}
+	return importDevices(cmd, inventory)
+}
+
+//importDevices saves the devices of inventory in a workspace without init info. The devices are stored by seqNo as
+//prefix_N whatever their names on thingsboard, and marked External so clean and -scaleTo never delete them.
+func importDevices(cmd *ImportCommand, inventory Inventory) error {
+	devices := inventory.Devices
+	if len(devices) == 0 {
+		return fmt.Errorf("no devices to import")
+	}
+
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].SeqNo < devices[j].SeqNo
+	})
+	for i, device := range devices {
+		if device.SeqNo != i {
+			return fmt.Errorf("device[%s] has seqNo %d, the seqNo of %d devices must be 0 to %d", device.Name, device.SeqNo, len(devices), len(devices)-1)
+		} else if len(device.Name) == 0 {
+			return fmt.Errorf("device of seqNo %d has no name", i)
+		} else if len(device.AuthToken) == 0 {
+			return fmt.Errorf("device[%s] %v", device.Name, ErrDeviceAuthTokenEmpty)
+		}
+	}
+
+	store, err := cmd.store.Open()
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		return err
+	}
+
+	if value, err := store.Get(KeyInitCmdInfo); err != nil {
+		return err
+	} else if len(value) > 0 {
+		return fmt.Errorf("workspace[%s] already has devices, import into another -workspace or clean it", cmd.store.Workspace)
+	}
+
+	info := inventory.Info
+	info.Password = ""
+	info.EncryptedPassword = ""
+	info.RefreshToken = ""
+	info.Credentials = CredentialsNone
+	info.DeviceNum = len(devices)
+	info.Imported = true
+	if len(cmd.serverHost) > 0 {
+		info.ServerHost = cmd.serverHost
+	}
+	if len(cmd.username) > 0 {
+		info.Username = cmd.username
+	}
+	if len(cmd.namePrefix) > 0 {
+		info.NamePrefix = cmd.namePrefix
+	}
+	if len(info.ProvisionMode) == 0 {
+		info.ProvisionMode = ProvisionModeRest
+	}
+
+	data, err := info.marshal()
+	if err != nil {
+		return err
+	}
+	puts := map[Key]Value{KeyInitCmdInfo: data}
+	for i, device := range devices {
+		device.External = true
+		value, err := json.Marshal(device)
+		if err != nil {
+			return err
+		}
+		puts[Key(info.deviceName(i))] = value
+	}
+
+	if err = store.Update(puts); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "%d devices imported as %s_0 to %s\n", len(devices), info.namePrefix(), info.deviceName(len(devices)-1))
+	return nil
+}
+
+//inventoryFormat returns format, or else the format of file by its extension
+func inventoryFormat(format, file string) (string, error) {
+	if len(format) == 0 {
+		if strings.EqualFold(filepath.Ext(file), "."+InventoryCsv) {
+			return InventoryCsv, nil
+		}
+		return InventoryJson, nil
+	}
+
+	switch strings.ToLower(format) {
+	case InventoryJson:
+		return InventoryJson, nil
+	case InventoryCsv:
+		return InventoryCsv, nil
+	default:
+		return "", fmt.Errorf("unknown format[%s], json or csv", format)
+	}
+}
+
+//writeInventory writes inventory to w, a csv has the devices only
+func writeInventory(w io.Writer, format string, inventory Inventory) error {
+	if format == InventoryJson {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(inventory)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(inventoryColumns); err != nil {
+		return err
+	}
+	for _, d := range inventory.Devices {
+		row := []string{d.Name, d.Id, d.AuthToken, strconv.Itoa(d.SeqNo), d.Type, d.Label, d.DeviceProfileId}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//readInventory reads what writeInventory wrote. A csv may have any of the columns in any order, only name and
+//token are needed, and devices without a seqNo are numbered by row.
+func readInventory(r io.Reader, format string) (Inventory, error) {
+	var inventory Inventory
+	if format == InventoryJson {
+		err := json.NewDecoder(r).Decode(&inventory)
+		return inventory, err
+	}
+
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return inventory, err
+	} else if len(rows) == 0 {
+		return inventory, fmt.Errorf("no header, the columns are %s", strings.Join(inventoryColumns, ","))
+	}
+
+	columns := make(map[string]int, len(rows[0]))
+	for i, name := range rows[0] {
+		column := ""
+		for _, c := range inventoryColumns {
+			if strings.EqualFold(strings.TrimSpace(name), c) {
+				column = c
+			}
+		}
+
+		if len(column) == 0 {
+			return inventory, fmt.Errorf("unknown column[%s], the columns are %s", name, strings.Join(inventoryColumns, ","))
+		} else if _, ok := columns[column]; ok {
+			return inventory, fmt.Errorf("column[%s] repeated", name)
+		}
+		columns[column] = i
+	}
+	for _, column := range []string{"name", "token"} {
+		if _, ok := columns[column]; !ok {
+			return inventory, fmt.Errorf("no column[%s]", column)
+		}
+	}
+
+	for i, row := range rows[1:] {
+		value := func(column string) string {
+			if index, ok := columns[column]; ok {
+				return strings.TrimSpace(row[index])
+			}
+			return ""
+		}
+
+		device := &Device{Id: value("id"), Name: value("name"), Type: value("type"), Label: value("label"),
+			AuthToken: value("token"), SeqNo: i, DeviceProfileId: value("deviceProfileId")}
+		if seqNo := value("seqNo"); len(seqNo) > 0 {
+			if device.SeqNo, err = strconv.Atoi(seqNo); err != nil {
+				return inventory, fmt.Errorf("row %d: seqNo[%s] is not a number", i+2, seqNo)
+			}
+		}
+		inventory.Devices = append(inventory.Devices, device)
+	}
+	return inventory, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportImport_Json(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "3", "-createProfile")
+	other := StoreFlags{Path: DbFileName, Workspace: "other"}
+	t.Cleanup(func() { _ = os.Remove("store.other.db") })
+
+	//the devices of one machine are shared with another through a file
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	path := writeConfig(t, "devices.json", "")
+	if err := main.Run(context.Background(), "export", "-file", path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"refreshToken"`) || !strings.Contains(string(data), `"provisionDeviceSecret": ""`) {
+		t.Fatalf("credentials exported %s", data)
+	}
+
+	if err = main.Run(context.Background(), "import", "-workspace", other.Workspace, "-file", path); err != nil {
+		t.Fatal(err)
+	}
+	if err = main.Run(context.Background(), "import", "-workspace", other.Workspace, "-file", path); err == nil {
+		t.Fatal("expected importing into a workspace with devices to fail")
+	}
+
+	_, exported, err := loadDevices(StoreFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, imported, err := loadDevices(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Imported || info.Credentials != CredentialsNone || info.DeviceNum != 3 || len(imported) != 3 {
+		t.Fatalf("unexpected import %+v %d devices", info, len(imported))
+	}
+	for i, device := range imported {
+		if !device.External || device.Name != exported[i].Name || device.AuthToken != exported[i].AuthToken {
+			t.Fatalf("device %+v imported as %+v", exported[i], device)
+		}
+	}
+
+	//clean of the importing machine keeps the devices and the profile of the exporting one
+	setEnv(t, envName("password"), FakePassword)
+	if err = main.Run(context.Background(), "clean", "-workspace", other.Workspace); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	devices, profiles := len(server.devices), len(server.profiles)
+	server.mu.Unlock()
+	if devices != 3 || profiles != 2 {
+		t.Fatalf("expected 3 devices and 2 profiles kept, got %d %d", devices, profiles)
+	}
+}
+
+func TestImportCommand_Csv(t *testing.T) {
+	server := NewFakeServer(FakeUsername, FakePassword)
+	t.Cleanup(func() {
+		server.Close()
+		_ = os.Remove(DbFileName)
+	})
+	setEnv(t, envName("password"), FakePassword)
+
+	//devices provisioned by other tooling, with names tbload would never give
+	var content strings.Builder
+	content.WriteString("Token, Name\n")
+	server.mu.Lock()
+	for _, name := range []string{"sensor-a", "sensor-b"} {
+		device, err := server.createDevice(SaveDeviceRequest{DeviceName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.WriteString(device.token + "," + name + "\n")
+	}
+	server.mu.Unlock()
+
+	main := NewMain()
+	main.Stdin = strings.NewReader(content.String())
+	main.Stdout = ioutil.Discard
+	args := []string{"import", "-file", "-", "-format", "csv", "-serverHost", server.URL, "-username", FakeUsername, "-namePrefix", "sensor"}
+	if err := main.Run(context.Background(), args...); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := startFakeBroker(t, FakeBrokerOptions{})
+	broker.Authenticate = server.Authenticate
+	broker.OnPublish = server.HandlePublish
+	args = []string{"run", "-brokerUrl", broker.URL(), "-concurrent", "2", "-messageNum", "5", "-timeout", "10", "-verify"}
+	if err := main.Run(context.Background(), args...); err != nil {
+		t.Fatal(err)
+	}
+	if stats := broker.Stats(); stats.Acked != 10 {
+		t.Fatalf("unexpected broker stats %+v", stats)
+	}
+
+	//clean removes the workspace without logging in, an imported csv may not even name its server
+	args = []string{"import", "-workspace", "csv", "-file", "-", "-format", "csv"}
+	main.Stdin = strings.NewReader(content.String())
+	if err := main.Run(context.Background(), args...); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove("store.csv.db") })
+	setEnv(t, envName("password"), "")
+	for _, workspace := range []string{DefaultWorkspace, "csv"} {
+		if err := main.Run(context.Background(), "clean", "-workspace", workspace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"sensor-a", "sensor-b"} {
+		if _, ok := server.device(name); !ok {
+			t.Fatalf("device %s deleted", name)
+		}
+	}
+}
+
+func TestReadInventory_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"unknown column":  "name,token,secret\na,t,s\n",
+		"repeated column": "name,token,Name\na,t,a\n",
+		"no token":        "name,id\na,1\n",
+		"seqNo":           "name,token,seqNo\na,t,first\n",
+		"no header":       "",
+	}
+
+	for name, content := range cases {
+		if _, err := readInventory(strings.NewReader(content), InventoryCsv); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestImportDevices_SeqNo(t *testing.T) {
+	t.Cleanup(func() { _ = os.Remove(DbFileName) })
+
+	cmd := &ImportCommand{Stdout: ioutil.Discard}
+	inventory, err := readInventory(strings.NewReader("name,token,seqNo\na,t,0\nb,t,2\n"), InventoryCsv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = importDevices(cmd, inventory); err == nil || !strings.Contains(err.Error(), "0 to 1") {
+		t.Fatalf("expected a seqNo gap to fail, got %v", err)
+	}
+
+	//rows are sorted by seqNo whatever their order
+	if inventory, err = readInventory(strings.NewReader("seqNo,name,token\n1,b,t1\n0,a,t0\n"), InventoryCsv); err != nil {
+		t.Fatal(err)
+	}
+	if err = importDevices(cmd, inventory); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := store.GetDevice(DeviceNamePrefix + "_1")
+	if err != nil || device.Name != "b" || device.AuthToken != "t1" || !device.External {
+		t.Fatalf("unexpected device %+v %v", device, err)
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -19,6 +22,9 @@ var (
 
 	// ErrUnknownCommand is returned when a CLI command is not specified.
 	ErrUnknownCommand = errors.New("unknown command")
+
+	// ErrInterrupted is returned when a run was stopped by SIGINT or SIGTERM.
+	ErrInterrupted = errors.New("interrupted")
 )
 
 const (
@@ -27,11 +33,13 @@ const (
 	KeyInitCmdInfo   = ToolPrefix + "_init_cmd_info"
 	KeyRunCmdInfo    = ToolPrefix + "_run_cmd_info"
 	KeySummary       = ToolPrefix + "_summary"
+	KeyQuerySummary  = ToolPrefix + "_query_summary"
+	KeySchemaVersion = ToolPrefix + "_schema_version"
 )
 
 func main() {
 	m := NewMain()
-	if err := m.Run(os.Args[1:]...); err == ErrUsage {
+	if err := m.Run(context.Background(), os.Args[1:]...); err == ErrUsage {
 		os.Exit(2)
 	} else if err != nil {
 		fmt.Println(err.Error())
@@ -56,7 +64,7 @@ func NewMain() *Main {
 }
 
 // Run executes the program.
-func (m *Main) Run(args ...string) error {
+func (m *Main) Run(ctx context.Context, args ...string) error {
 	// Require a command at the beginning.
 	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
 		fmt.Fprintln(m.Stderr, m.Usage())
@@ -69,13 +77,27 @@ func (m *Main) Run(args ...string) error {
 		fmt.Fprintln(m.Stderr, m.Usage())
 		return ErrUsage
 	case "init":
-		return newInitCommand(m).Run(args[1:]...)
+		return newInitCommand(m).Run(ctx, args[1:]...)
 	case "info":
-		return newInfoCommand(m).Run(args[1:]...)
+		return newInfoCommand(m).Run(ctx, args[1:]...)
 	case "run":
-		return newRunCommand(m).Run(args[1:]...)
+		return newRunCommand(m).Run(ctx, args[1:]...)
 	case "clean":
-		return newCleanCommand(m).Run(args[1:]...)
+		return newCleanCommand(m).Run(ctx, args[1:]...)
+	case "verify":
+		return newVerifyCommand(m).Run(ctx, args[1:]...)
+	case "subscribe":
+		return newSubscribeCommand(m).Run(ctx, args[1:]...)
+	case "query":
+		return newQueryCommand(m).Run(ctx, args[1:]...)
+	case "fake-server":
+		return newFakeServerCommand(m).Run(ctx, args[1:]...)
+	case "fake-broker":
+		return newFakeBrokerCommand(m).Run(ctx, args[1:]...)
+	case "export":
+		return newExportCommand(m).Run(ctx, args[1:]...)
+	case "import":
+		return newImportCommand(m).Run(ctx, args[1:]...)
 	default:
 		return ErrUnknownCommand
 	}
@@ -85,6 +107,8 @@ type InfoCommand struct {
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
+
+	store StoreFlags
 }
 
 func newInfoCommand(m *Main) *InfoCommand {
@@ -95,22 +119,30 @@ func newInfoCommand(m *Main) *InfoCommand {
 	}
 }
 
-func (cmd *InfoCommand) Run(args ...string) error {
+func (cmd *InfoCommand) Run(ctx context.Context, args ...string) error {
 
 	fs := flag.NewFlagSet("info", flag.ContinueOnError)
 
 	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
 	printKVs := fs.Bool("d", false, "print key/value pairs in data store")
-	//printSummary := fs.Bool("s", false, "print summary")
+	printLastSummary := fs.Bool("s", false, "print summary of the last run")
+	printLastIntervals := fs.Bool("i", false, "print per-second intervals of the last run")
+	printLastQuery := fs.Bool("q", false, "print summary of the last query")
+	printWorkspaceList := fs.Bool("workspaces", false, "print the workspaces next to the store")
 
-	if err := fs.Parse(args); err != nil {
+	if err := parseFlags(fs, args); err != nil {
 		return err
 	} else if *help {
 		fs.Usage()
 		return nil
 	}
 
-	store, err := OpenDeviceStore()
+	if *printWorkspaceList {
+		return printWorkspaces(cmd.Stdout, cmd.store)
+	}
+
+	store, err := cmd.store.Open()
 	if err != nil {
 		return err
 	}
@@ -120,13 +152,28 @@ func (cmd *InfoCommand) Run(args ...string) error {
 		return store.PrintAll(cmd.Stdout)
 	}
 
-	//if *printSummary {
-	//	if summary, err := store.GetSummary(KeySummary); err != nil {
-	//		return err
-	//	} else {
-	//		printSummary(summary)
-	//	}
-	//}
+	if *printLastSummary || *printLastIntervals {
+		summary, err := store.GetSummary(KeySummary)
+		if err != nil {
+			return err
+		}
+
+		if *printLastSummary {
+			printSummary(summary)
+		}
+
+		if *printLastIntervals {
+			printIntervals(summary.Intervals)
+		}
+	}
+
+	if *printLastQuery {
+		summary, err := store.GetQuerySummary()
+		if err != nil {
+			return err
+		}
+		printQuerySummary(summary)
+	}
 
 	return nil
 }
@@ -136,14 +183,31 @@ type InitCommand struct {
 	Stdout io.Writer
 	Stderr io.Writer
 
-	info InitCommandInfo
+	store   StoreFlags
+	info    InitCommandInfo
+	workers int
+	rps     float64
+	scaleTo int
 }
 
 type InitCommandInfo struct {
-	ServerHost string `json:"serverHost"`
-	Username   string `json:"username"`
-	Password   string `json:"password"`
-	DeviceNum  int    `json:"deviceNum"`
+	ServerHost        string      `json:"serverHost"`
+	Username          string      `json:"username"`
+	Password          string      `json:"password,omitempty"` //only saved by older versions
+	Credentials       string      `json:"credentials"`
+	EncryptedPassword string      `json:"encryptedPassword,omitempty"`
+	RefreshToken      string      `json:"refreshToken,omitempty"`
+	DeviceNum         int         `json:"deviceNum"`
+	NamePrefix        string      `json:"namePrefix"`
+	DeviceType        string      `json:"deviceType"`
+	Label             string      `json:"label"`
+	DeviceProfile     string      `json:"deviceProfile"`
+	DeviceProfileId   string      `json:"deviceProfileId"`
+	CreateProfile     bool        `json:"createProfile"`
+	Profile           ProfileInfo `json:"profile"`
+	ProvisionMode     string      `json:"provisionMode"`
+	BrokerUrl         string      `json:"brokerUrl"`
+	Imported          bool        `json:"imported,omitempty"` //saved by import, clean keeps the device profile
 }
 
 func newInitCommand(m *Main) *InitCommand {
@@ -154,74 +218,131 @@ func newInitCommand(m *Main) *InitCommand {
 	}
 }
 
-func (cmd *InitCommand) Run(args ...string) error {
+func (cmd *InitCommand) Run(ctx context.Context, args ...string) error {
 	fs := flag.NewFlagSet("init", flag.ContinueOnError)
 	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
 
 	fs.StringVar(&cmd.info.ServerHost, "serverHost", "", "thingsboard server host (e.g., http://demo.thingsboard.io)")
 	fs.StringVar(&cmd.info.Username, "username", "", "name of thingsboard tenant user (e.g., tenant@thingsboard.org)")
 	fs.StringVar(&cmd.info.Password, "password", "", " password of thingsboard tenant user")
+	fs.StringVar(&cmd.info.Credentials, "credentials", CredentialsRefreshToken, "how the credentials are saved in store: "+
+		"refreshToken, encrypted (the password, with the key of "+EnvKey+" or "+EnvKeyFile+") or none (then "+EnvPrefix+"PASSWORD is needed)")
 	fs.IntVar(&cmd.info.DeviceNum, "deviceNum", 10, "number of devices to test")
-
-	if err := fs.Parse(args); err != nil {
+	fs.StringVar(&cmd.info.NamePrefix, "namePrefix", DeviceNamePrefix, "device name prefix, devices are named prefix_N")
+	fs.StringVar(&cmd.info.DeviceType, "deviceType", "default", "device type")
+	fs.StringVar(&cmd.info.Label, "label", "", "device label")
+	fs.StringVar(&cmd.info.DeviceProfile, "deviceProfile", "", "name of the device profile to assign. empty means the default profile")
+	fs.BoolVar(&cmd.info.CreateProfile, "createProfile", false, "create or update the device profile named by -deviceProfile (default prefix_profile) and remove it on clean")
+	fs.StringVar(&cmd.info.Profile.TelemetryTopic, "telemetryTopic", tbPubTopic, "telemetry topic filter of the created profile")
+	fs.StringVar(&cmd.info.Profile.AttributesTopic, "attributesTopic", tbAttributesTopic, "attributes topic filter of the created profile")
+	fs.StringVar(&cmd.info.Profile.PayloadType, "payloadType", PayloadTypeJson, "payload type of the created profile, JSON or PROTOBUF")
+	fs.StringVar(&cmd.info.Profile.ProtoSchema, "protoSchema", "", ".proto file with the telemetry schema of the created profile, required for PROTOBUF")
+	fs.StringVar(&cmd.info.Profile.ProvisionType, "provisionType", ProvisionDisabled, "provision strategy of the created profile, DISABLED, ALLOW_CREATE_NEW_DEVICES or CHECK_PRE_PROVISIONED_DEVICES")
+	fs.StringVar(&cmd.info.Profile.ProvisionDeviceKey, "provisionDeviceKey", "", "provision device key of the created profile. empty means a random one")
+	fs.StringVar(&cmd.info.Profile.ProvisionDeviceSecret, "provisionDeviceSecret", "", "provision device secret of the created profile. empty means a random one")
+	fs.StringVar(&cmd.info.Profile.AlarmRules, "alarmRules", "", "json file with an array of alarm rules of the created profile")
+	fs.StringVar(&cmd.info.ProvisionMode, "provisionMode", ProvisionModeRest, "how devices are created, rest by the tenant or mqtt by the devices through the provisioning api")
+	fs.StringVar(&cmd.info.BrokerUrl, "brokerUrl", "", "thingsboard mqtt transport for -provisionMode mqtt (e.g., tcp://demo.thingsboard.io:1883)")
+	fs.IntVar(&cmd.workers, "workers", 1, "number of devices to create in parallel")
+	fs.Float64Var(&cmd.rps, "rps", 0, "max rest api requests per second. 0 means no limit")
+	fs.IntVar(&cmd.scaleTo, "scaleTo", -1, "create or delete devices in store until there are scaleTo devices")
+
+	if err := parseFlags(fs, args); err != nil {
 		return err
 	} else if *help {
 		fs.Usage()
 		return nil
-	} else if len(cmd.info.ServerHost) == 0 || len(cmd.info.Username) == 0 || len(cmd.info.Password) == 0 {
+	} else if cmd.workers < 1 {
 		fs.Usage()
 		return ErrUsage
+	} else if cmd.scaleTo >= 0 {
+		return scaleDevices(ctx, cmd)
+	} else if len(cmd.info.ServerHost) == 0 || len(cmd.info.Username) == 0 || len(cmd.info.Password) == 0 || len(cmd.info.NamePrefix) == 0 {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	switch cmd.info.ProvisionMode {
+	case ProvisionModeRest:
+	case ProvisionModeMqtt:
+		if len(cmd.info.BrokerUrl) == 0 {
+			return fmt.Errorf("-provisionMode mqtt needs -brokerUrl")
+		}
+
+		//the created profile must accept new devices, otherwise the credentials are given by flags
+		if cmd.info.CreateProfile && cmd.info.Profile.ProvisionType == ProvisionDisabled {
+			cmd.info.Profile.ProvisionType = ProvisionAllowCreateNewDevices
+		} else if !cmd.info.CreateProfile && (len(cmd.info.Profile.ProvisionDeviceKey) == 0 || len(cmd.info.Profile.ProvisionDeviceSecret) == 0) {
+			return fmt.Errorf("-provisionMode mqtt needs -createProfile or -provisionDeviceKey and -provisionDeviceSecret")
+		}
+	default:
+		return fmt.Errorf("unknown provision mode[%s]", cmd.info.ProvisionMode)
+	}
+
+	if err := cmd.info.checkCredentials(); err != nil {
+		return err
+	}
+
+	user, err := cmd.info.tenantUser(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = cmd.info.keepCredentials(user); err != nil {
+		return err
 	}
 
-	if err := checkLogin(cmd); err != nil {
+	if cmd.info.CreateProfile {
+		if err := createDeviceProfile(ctx, cmd); err != nil {
+			return err
+		}
+	} else if err := resolveDeviceProfile(ctx, cmd); err != nil {
 		return err
 	}
 
-	if err := save(cmd.info); err != nil {
+	if err := save(cmd); err != nil {
 		return err
 	}
 
-	if err := createDevices(cmd); err != nil {
+	if err := createDevices(ctx, cmd); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-//checkLogin check account validity.
-func checkLogin(cmd *InitCommand) error {
-	serverHost := cmd.info.ServerHost
-	username := cmd.info.Username
-	password := cmd.info.Password
+//resolveDeviceProfile looks up the id of the device profile named by -deviceProfile
+func resolveDeviceProfile(ctx context.Context, cmd *InitCommand) error {
+	if len(cmd.info.DeviceProfile) == 0 {
+		return nil
+	}
 
-	user, err := NewTenantUser(serverHost, username, password)
+	user, err := cmd.info.tenantUser(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	if err = user.Login(); err != nil {
-		return err
+	if cmd.info.DeviceProfileId, err = user.GetDeviceProfileId(ctx, cmd.info.DeviceProfile); err == ErrDeviceProfileNotExist {
+		return fmt.Errorf("device profile[%s] not exist", cmd.info.DeviceProfile)
 	}
-
-	return nil
+	return err
 }
 
 //save saves cmd info in store
-func save(info InitCommandInfo) error {
-	store, err := OpenDeviceStore()
+func save(cmd *InitCommand) error {
+	store, err := cmd.store.Open()
 	defer func() { _ = store.Close() }()
 	if err != nil {
 		return err
 	}
 
-	return info.Store(store)
+	return cmd.info.Store(store)
 }
 
 //forEach iterates on deviceName
 func (info *InitCommandInfo) forEach(fn func(info *InitCommandInfo, index int, deviceName string) error) error {
 	for i := 0; i < info.DeviceNum; i++ {
-		name := DeviceNamePrefix + "_" + strconv.Itoa(i)
-		err := fn(info, i, name)
+		err := fn(info, i, info.deviceName(i))
 		if err != nil {
 			return err
 		}
@@ -229,9 +350,28 @@ func (info *InitCommandInfo) forEach(fn func(info *InitCommandInfo, index int, d
 	return nil
 }
 
+//namePrefix returns the device name prefix, info saved by older versions has none
+func (info *InitCommandInfo) namePrefix() string {
+	if len(info.NamePrefix) == 0 {
+		return DeviceNamePrefix
+	}
+	return info.NamePrefix
+}
+
+//deviceName returns the name of the device at index
+func (info *InitCommandInfo) deviceName(index int) string {
+	return info.namePrefix() + "_" + strconv.Itoa(index)
+}
+
+//marshal encodes info to be saved, without the password
+func (info InitCommandInfo) marshal() ([]byte, error) {
+	info.Password = ""
+	return json.Marshal(info)
+}
+
 //store saves info in store
 func (info *InitCommandInfo) Store(store *DeviceStore) error {
-	data, err := json.Marshal(info)
+	data, err := info.marshal()
 	if err != nil {
 		return err
 	}
@@ -252,73 +392,108 @@ func (info *InitCommandInfo) Restore(store *DeviceStore) error {
 	return json.Unmarshal(value, info)
 }
 
-//createDevices creates devices on thingsboard
-func createDevices(cmd *InitCommand) error {
+//createDevices creates devices on thingsboard with cmd.workers in parallel
+func createDevices(ctx context.Context, cmd *InitCommand) error {
 	info := cmd.info
 
-	user, err := NewTenantUser(info.ServerHost, info.Username, info.Password)
-	if err != nil {
-		return err
-	}
-
-	err = user.Login()
+	user, err := info.tenantUser(ctx, nil)
 	if err != nil {
 		return err
 	}
+	user.Limiter = NewRateLimiter(cmd.rps)
 
-	store, err := OpenDeviceStore()
+	store, err := cmd.store.Open()
 	defer func() { _ = store.Close() }()
 	if err != nil {
 		return err
 	}
 
-	return info.forEach(func(info *InitCommandInfo, index int, deviceName string) error {
-		device, err2 := user.GetDevice(deviceName)
-		if err2 != nil {
-			return err2
-		}
-
-		//if exist, save info then return
-		if len(device.Id) > 0 {
-			return store.SaveDevice(device)
-		}
-
-		device, err2 = NewDevice(deviceName)
-		if err2 != nil {
-			return err2
-		}
+	indexes := make([]int, info.DeviceNum)
+	for i := range indexes {
+		indexes[i] = i
+	}
 
-		if err2 = user.CreateDevice(device); err2 != nil {
-			return err2
-		}
+	provision, report := cmd.provisioner(user)
+	defer report()
 
-		device.AuthToken, err2 = user.GetDeviceAuthToken(device.Id)
+	return runWorkers(ctx, cmd.Stdout, indexes, cmd.workers, func(ctx context.Context, bar *ProgressBar, index int) error {
+		deviceName := info.deviceName(index)
+		device, err2 := provision(ctx, index)
 		if err2 == ErrDeviceAuthTokenEmpty {
-			fmt.Printf("device[%s] got empty AuthToken\n", deviceName)
+			bar.Printf("device[%s] got empty AuthToken\n", deviceName)
 		} else if err2 != nil {
-			return err2
+			return fmt.Errorf("device[%s]: %v", deviceName, err2)
 		}
 
-		fmt.Fprintf(cmd.Stdout, "created device[%s]\n", deviceName)
 		return store.SaveDevice(device)
 	})
 }
 
+//scaleDevices creates or deletes devices until the store holds cmd.scaleTo devices.
+//Progress is checkpointed in store, an interrupted scale resumes where it stopped.
+func scaleDevices(ctx context.Context, cmd *InitCommand) error {
+	store, err := cmd.store.Open()
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.info.Restore(store); err != nil {
+		return err
+	}
+	from := cmd.info.DeviceNum
+
+	user, err := cmd.info.tenantUser(ctx, nil)
+	if err != nil {
+		return err
+	}
+	user.Limiter = NewRateLimiter(cmd.rps)
+
+	//a store of an older version keeps the refresh token instead of the password from now on
+	if err = cmd.info.keepCredentials(user); err != nil {
+		return err
+	}
+
+	if cmd.scaleTo >= from {
+		err = scaleUp(ctx, cmd, user, store, cmd.scaleTo)
+	} else {
+		err = scaleDown(ctx, cmd, user, store, cmd.scaleTo)
+	}
+	if err2 := saveRefreshToken(store, user); err == nil {
+		err = err2
+	}
+
+	var scaled InitCommandInfo
+	if err2 := scaled.Restore(store); err2 == nil {
+		fmt.Fprintf(cmd.Stdout, "scaled from %d to %d devices\n", from, scaled.DeviceNum)
+	}
+	return err
+}
+
 type RunCommand struct {
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
 
-	info RunCommandInfo
+	store StoreFlags
+	info  RunCommandInfo
 }
 
 type RunCommandInfo struct {
-	BrokerUrl      string `json:"brokerUrl"`
-	MessageNum     int    `json:"messageNum"`
-	Timeout        int    `json:"timeout"`
-	ConcurrentNum  int    `json:"concurrentNum"`
-	StartNum       int    `json:"startNum"`
-	ConnectTimeout int    `json:"connectTimeout"`
+	BrokerUrl       string `json:"brokerUrl"`
+	MessageNum      int    `json:"messageNum"`
+	Timeout         int    `json:"timeout"`
+	ConcurrentNum   int    `json:"concurrentNum"`
+	StartNum        int    `json:"startNum"`
+	ConnectTimeout  int    `json:"connectTimeout"`
+	ReportIntervals bool   `json:"reportIntervals"`
+	MetricsAddr     string `json:"metricsAddr"`
+	Topic           string `json:"topic"`
+	PayloadFormat   string `json:"payloadFormat"`
+	ProtoSchema     string `json:"protoSchema"`
+	Verify          bool   `json:"verify"`
+	IngestSample    int    `json:"ingestSample"`
+	ServerTs        bool   `json:"serverTs"`
 }
 
 func newRunCommand(m *Main) *RunCommand {
@@ -329,18 +504,27 @@ func newRunCommand(m *Main) *RunCommand {
 	}
 }
 
-func (cmd *RunCommand) Run(args ...string) error {
+func (cmd *RunCommand) Run(ctx context.Context, args ...string) error {
 	fs := flag.NewFlagSet("run", flag.ContinueOnError)
 
 	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
 	fs.StringVar(&cmd.info.BrokerUrl, "brokerUrl", "", "thingsboard mqtt transport (e.g., tcp://demo.thingsboard.io:1883)")
 	fs.IntVar(&cmd.info.Timeout, "timeout", 10, "timeout of wait")
 	fs.IntVar(&cmd.info.MessageNum, "messageNum", 10, "number of message to send")
 	fs.IntVar(&cmd.info.ConcurrentNum, "concurrent", 1, "concurrent number of device to connect")
 	fs.IntVar(&cmd.info.StartNum, "startNum", 0, "start num of device to start")
 	fs.IntVar(&cmd.info.ConnectTimeout, "connectTimeout", 0, "connect timeout. 0 means wait until total timeout ")
-
-	if err := fs.Parse(args); err != nil {
+	fs.BoolVar(&cmd.info.ReportIntervals, "reportIntervals", true, "write the per-second intervals into the report")
+	fs.StringVar(&cmd.info.MetricsAddr, "metricsAddr", "", "serve prometheus metrics on this address while running (e.g., :9100)")
+	fs.StringVar(&cmd.info.Topic, "topic", "", "telemetry topic to publish to. empty means the topic of the profile created by init")
+	fs.IntVar(&cmd.info.IngestSample, "ingestSample", 0, "measure ingest latency on websocket subscriptions of this many devices. 0 means off")
+	fs.BoolVar(&cmd.info.Verify, "verify", false, "verify the published telemetry was persisted after the run")
+	fs.BoolVar(&cmd.info.ServerTs, "serverTs", false, "leave ts out of the messages, thingsboard stamps every delivery so verify sees duplicated and reordered ones")
+	fs.StringVar(&cmd.info.PayloadFormat, "payloadFormat", "", "payload format, json or protobuf. empty means the payload type of the profile created by init")
+	fs.StringVar(&cmd.info.ProtoSchema, "protoSchema", "", ".proto file of protobuf payloads. empty means the schema of the profile created by init")
+
+	if err := parseFlags(fs, args); err != nil {
 		return err
 	} else if *help {
 		fs.Usage()
@@ -350,7 +534,7 @@ func (cmd *RunCommand) Run(args ...string) error {
 		return nil
 	}
 
-	store, err := OpenDeviceStore()
+	store, err := cmd.store.Open()
 	if err != nil {
 		return err
 	}
@@ -362,6 +546,24 @@ func (cmd *RunCommand) Run(args ...string) error {
 		return err
 	}
 
+	if len(cmd.info.Topic) == 0 {
+		cmd.info.Topic = initCmdInfo.telemetryTopic()
+	}
+
+	if len(cmd.info.PayloadFormat) == 0 {
+		cmd.info.PayloadFormat = initCmdInfo.payloadType()
+	}
+
+	if len(cmd.info.ProtoSchema) == 0 {
+		cmd.info.ProtoSchema = initCmdInfo.Profile.ProtoSchema
+	}
+
+	encoder, err := newPayloadEncoder(cmd.info.PayloadFormat, cmd.info.ProtoSchema)
+	if err != nil {
+		return err
+	}
+	opts := publishOptions{topic: cmd.info.Topic, messageNum: cmd.info.MessageNum, encoder: encoder, serverTs: cmd.info.ServerTs, stderr: cmd.Stderr}
+
 	//calculate condition variable
 	if cmd.info.StartNum < 0 || cmd.info.StartNum+1 > initCmdInfo.DeviceNum {
 		return fmt.Errorf("startNum[%d] out of range[0-%d]", cmd.info.StartNum, initCmdInfo.DeviceNum)
@@ -377,14 +579,13 @@ func (cmd *RunCommand) Run(args ...string) error {
 	}
 
 	timeout := time.Duration(cmd.info.Timeout) * time.Second
-	connectTimeout := timeout
-	if cmd.info.ConnectTimeout > 0 {
-		connectTimeout = time.Duration(cmd.info.ConnectTimeout) * time.Second
-	}
+	connectTimeout := time.Duration(cmd.info.ConnectTimeout) * time.Second
 
 	//init clients for every device
+	stats := &RunStats{}
 	clients := make([]*MqttClient, concurrent)
 	defer func() { closeClients(clients) }()
+	devices := make(map[string]*Device, concurrent)
 
 	if err = initCmdInfo.forEach(func(info *InitCommandInfo, index int, deviceName string) error {
 		device, err2 := store.GetDevice(deviceName)
@@ -403,146 +604,276 @@ func (cmd *RunCommand) Run(args ...string) error {
 		username := device.AuthToken
 		password := ""
 		brokerUrl := cmd.info.BrokerUrl
-		clients[index-startNum] = NewMqttClient(clientId, username, password, brokerUrl)
+		client := NewMqttClient(clientId, username, password, brokerUrl)
+		client.stats = stats
+		clients[index-startNum] = client
+		devices[clientId] = device
 		return nil
 	}); err != nil {
 		return err
 	}
 	fmt.Fprintf(cmd.Stdout, "%d clients init\n", len(clients))
 
+	//the store is locked while open, it is reopened to save the run so subscribe, query and verify can run meanwhile
+	if err = store.Close(); err != nil {
+		return err
+	}
+
+	//cancel all goroutines on SIGINT or SIGTERM
+	ctx, cancel := notifyContext(ctx)
+	defer cancel()
+
+	if len(cmd.info.MetricsAddr) > 0 {
+		server, err := startMetricsServer(cmd.info.MetricsAddr, stats)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = server.Close() }()
+		fmt.Fprintf(cmd.Stdout, "serving metrics on %s%s\n", cmd.info.MetricsAddr, metricsPath)
+	}
+	stopProgress := stats.StartProgress(cmd.Stdout, progressInterval, concurrent)
+
 	//connects all devices
-	connectedQueue := make(chan Connected)
-	for _, c := range clients {
-		go func(c *MqttClient) {
+	connectCtx, cancelConnect := context.WithTimeout(ctx, timeout)
+	defer cancelConnect()
+	connectedQueue := make(chan Connected, concurrent)
+	connected := make([]Connected, concurrent)
+	for i, c := range clients {
+		go func(i int, c *MqttClient) {
 			fmt.Fprintf(cmd.Stdout, "client[%s] begin connect..\n", c.Id)
-			connected, _ := c.ConnectAndWait(timeout, connectTimeout)
-			fmt.Fprintf(cmd.Stdout, "client[%s] connected = %v \n", c.Id, connected)
-			connectedQueue <- connected
-		}(c)
+			ok, _ := c.ConnectAndWait(connectCtx, connectTimeout)
+			if !ok {
+				stats.ConnectFailed()
+			}
+			fmt.Fprintf(cmd.Stdout, "client[%s] connected = %v \n", c.Id, ok)
+			connected[i] = ok
+			connectedQueue <- ok
+		}(i, c)
 	}
 
+	//every client reports once connectCtx is done
 	var nConnected int
-	var counter int
-	timer := time.NewTimer(timeout)
-	isConnectTimeout := false
-	for loop := true; loop; {
-		select {
-		case v := <-connectedQueue:
-			counter += 1
-			if v {
-				nConnected += 1
-			}
-
-			if counter == concurrent {
-				fmt.Fprintln(cmd.Stdout, "complete ..")
-				loop = false
-			}
+	for i := 0; i < concurrent; i++ {
+		if <-connectedQueue {
+			nConnected += 1
+		}
+	}
 
-		case <-timer.C:
-			fmt.Fprintln(cmd.Stdout, "timeout ..")
-			isConnectTimeout = true
-			loop = false
+	if ctx.Err() != nil {
+		fmt.Fprintln(cmd.Stdout, "interrupted ..")
+		//nothing was published, every client is reported as interrupted
+		results := make([]Result, concurrent)
+		for i, c := range clients {
+			results[i] = Result{ClientId: c.Id, Event: InterruptedEvent}
+		}
+		intervals := stopProgress()
+		if store, err = cmd.store.Open(); err != nil {
+			return err
 		}
+		return cmd.report(store, concurrent, results, stats, intervals, true)
 	}
 
-	if isConnectTimeout {
-		return fmt.Errorf("only %d/%d devices connected!", nConnected, concurrent)
+	if nConnected == 0 {
+		//the failed run is saved as well, every client is reported as failed to connect
+		results := make([]Result, concurrent)
+		for i, c := range clients {
+			results[i] = Result{ClientId: c.Id, Event: ConnectFailedEvent, Error: true}
+		}
+		intervals := stopProgress()
+		if store, err = cmd.store.Open(); err != nil {
+			return err
+		}
+		if err = cmd.report(store, concurrent, results, stats, intervals, false); err != nil {
+			return err
+		}
+		return fmt.Errorf("none of %d devices connected!", concurrent)
+	}
+	fmt.Fprintln(cmd.Stdout, "complete ..")
+
+	//devices which failed to connect are reported, the others publish
+	results := make([]Result, 0, concurrent)
+	publishers := make([]*MqttClient, 0, nConnected)
+	for i, c := range clients {
+		if connected[i] {
+			publishers = append(publishers, c)
+		} else {
+			results = append(results, Result{ClientId: c.Id, Event: ConnectFailedEvent, Error: true})
+		}
+	}
+	if nConnected < concurrent {
+		fmt.Printf("only %d/%d devices connected!\n", nConnected, concurrent)
+	} else {
+		fmt.Printf("all %d devices connected!\n", nConnected)
 	}
 
-	if nConnected < counter {
-		return fmt.Errorf("only %d/%d devices connected!", nConnected, concurrent)
+	publishStart := time.Now()
+	var monitor *IngestMonitor
+	var sampled map[string]bool
+	if cmd.info.IngestSample > 0 {
+		monitor, sampled, err = startIngestMonitor(ctx, &initCmdInfo, devices, publishers, cmd.info.IngestSample, cmd.info.PayloadFormat, publishStart, stats, cmd.Stderr)
+		if err != nil {
+			stopProgress()
+			return fmt.Errorf("ingest monitor: %v", err)
+		}
+		fmt.Fprintf(cmd.Stdout, "watching %d devices on websocket\n", len(sampled))
 	}
-	fmt.Printf("all %d devices connected!\n", nConnected)
 
 	//send messages
 	fmt.Fprintln(cmd.Stdout, "sending messages...")
-	resultQueue := make(chan Result, concurrent)
-	for _, c := range clients {
-
+	publishCtx, cancelPublish := context.WithTimeout(ctx, timeout)
+	defer cancelPublish()
+	resultQueue := make(chan Result, nConnected)
+	for _, c := range publishers {
 		go func(c *MqttClient) {
-			startTime := time.Now()
-			ts := startTime.Unix() * 1000
-			var published Published
-			var count int
-			timer := time.NewTimer(timeout)
-			for i := 0; i < cmd.info.MessageNum; i++ {
-				select {
-				case <-timer.C:
-					fmt.Printf("timeout [%s]\n", c.Id)
-					resultQueue <- Result{
-						ClientId:         c.Id,
-						Event:            TimeoutExceededEvent,
-						Error:            true,
-						PublishDoneTime:  time.Since(startTime),
-						MessagePublished: count,
-					}
-					break
-				default:
-					ts += 1
-					template := `{"ts":%d, "values":{"%s_key":1.4}}`
-					payload := fmt.Sprintf(template, ts, ToolPrefix)
-					published, _ = c.PublishAndWait(tbPubTopic, payload, timeout)
-					if !published {
-						resultQueue <- Result{
-							ClientId:         c.Id,
-							Event:            PublishFailEvent,
-							Error:            true,
-							PublishDoneTime:  time.Since(startTime),
-							MessagePublished: count,
-						}
-						break
-					} else {
-						count += 1
-					}
-				}
-			}
+			resultQueue <- publishMessages(publishCtx, c, opts, stats)
+		}(c)
+	}
+
+	//every client reports once publishCtx is done
+	for range publishers {
+		results = append(results, <-resultQueue)
+	}
+	intervals := stopProgress()
+	fmt.Fprintf(cmd.Stdout, "received %d \n", len(results))
 
-			if count == cmd.info.MessageNum {
-				//fmt.Printf("complete [%s]\n", c.Id)
-				resultQueue <- Result{
-					ClientId:         c.Id,
-					Event:            PublishCompleteEvent,
-					Error:            false,
-					PublishDoneTime:  time.Since(startTime),
-					MessagePublished: count,
-				}
+	if monitor != nil {
+		var expected int
+		for _, result := range results {
+			if sampled[result.ClientId] {
+				expected += result.MessagePublished
 			}
-		}(c)
+		}
+		monitor.Wait(ctx, expected, ingestGrace)
+		monitor.Stop()
+		fmt.Fprintf(cmd.Stdout, "%d/%d sampled messages arrived on websocket\n", monitor.Received(), expected)
+	}
 
+	if store, err = cmd.store.Open(); err != nil {
+		return err
+	}
+	record := newRunRecord(publishStart, cmd.info.MessageNum, cmd.info.PayloadFormat, cmd.info.ServerTs, results)
+	if err = record.Store(store); err != nil {
+		return err
 	}
 
-	timer = time.NewTimer(timeout * 2)
-	results := make([]Result, concurrent)
-	j := 0
-LOOP2:
-	for {
-		select {
-		case r := <-resultQueue:
-			results[j] = r
-			j += 1
-			if j == concurrent {
-				break LOOP2
+	if err = cmd.report(store, concurrent, results, stats, intervals, ctx.Err() != nil); err != nil || !cmd.info.Verify {
+		return err
+	}
+	return verifyRun(ctx, cmd.Stdout, store, 1)
+}
+
+//publishOptions describes the messages every client publishes
+type publishOptions struct {
+	topic      string
+	messageNum int
+	encoder    PayloadEncoder
+	serverTs   bool      //messages have no ts
+	stderr     io.Writer //diagnostics of the clients
+}
+
+//publishMessages publishes opts.messageNum messages with client c until ctx is done.
+func publishMessages(ctx context.Context, c *MqttClient, opts publishOptions, stats *RunStats) Result {
+	startTime := time.Now()
+	ts := startTime.Unix() * 1000
+	var count, sent int
+
+	result := func(event string, isError bool) Result {
+		return Result{
+			ClientId:         c.Id,
+			Event:            event,
+			Error:            isError,
+			PublishDoneTime:  time.Since(startTime),
+			MessagePublished: count,
+			MessageSent:      sent,
+		}
+	}
+
+	for i := 0; i < opts.messageNum && ctx.Err() == nil; i++ {
+		sendTime := time.Now()
+		ts += 1
+		message := Telemetry{
+			Ts:     ts,
+			Seq:    i,
+			Sent:   sendTime.UnixNano() / int64(time.Millisecond),
+			Values: map[string]interface{}{ToolPrefix + "_key": 1.4},
+		}
+		if opts.serverTs {
+			message.Ts = 0
+		}
+		payload, err := opts.encoder.Encode(message)
+		if err != nil {
+			fmt.Fprintf(opts.stderr, "client[%s] encode payload: %v\n", c.Id, err)
+			return result(PublishFailEvent, true)
+		}
+		stats.Published()
+		sent++
+		if published, _ := c.PublishAndWait(ctx, opts.topic, payload); !published {
+			//a publish cut short by ctx is not a failure of the broker
+			if err := ctx.Err(); err == context.DeadlineExceeded {
+				stats.TimedOut()
+				break
+			} else if err != nil {
+				break
 			}
-		case <-timer.C:
-			fmt.Fprintf(cmd.Stdout, "receive timeout...\n")
-			break LOOP2
+			stats.Failed()
+			return result(PublishFailEvent, true)
 		}
+		stats.Acked(time.Since(sendTime))
+		count += 1
 	}
-	fmt.Fprintf(cmd.Stdout, "received %d \n", j)
 
+	if count == opts.messageNum {
+		return result(PublishCompleteEvent, false)
+	} else if ctx.Err() == context.DeadlineExceeded {
+		fmt.Printf("timeout [%s]\n", c.Id)
+		return result(TimeoutExceededEvent, true)
+	}
+	return result(InterruptedEvent, false)
+}
+
+//report builds, prints and saves the summary of a run
+func (cmd *RunCommand) report(store *DeviceStore, concurrent int, results []Result, stats *RunStats, intervals []Interval, interrupted bool) error {
 	summary, err := buildSummary(concurrent, cmd.info.MessageNum, results)
 	if err != nil {
 		return err
 	}
+	summary.Interrupted = interrupted
+	if cmd.info.ReportIntervals {
+		summary.Intervals = intervals
+	}
+	summary.PubackLatency, summary.IngestLatency = stats.Latencies()
 	printSummary(summary)
-	//store.SaveSummary(KeySummary, summary)
+
+	if err = store.SaveSummary(KeySummary, summary); err != nil {
+		return err
+	}
+
+	if interrupted {
+		return ErrInterrupted
+	}
 	return nil
 }
 
+//notifyContext returns a context which is canceled on SIGINT or SIGTERM
+func notifyContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 func closeClients(clients []*MqttClient) {
 	for _, c := range clients {
 		if c != nil && c.Client != nil {
-			c.Client.Disconnect(5)
+			c.Close()
 		}
 	}
 }
@@ -551,6 +882,8 @@ type CleanCommand struct {
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
+
+	store StoreFlags
 }
 
 func newCleanCommand(m *Main) *CleanCommand {
@@ -561,24 +894,25 @@ func newCleanCommand(m *Main) *CleanCommand {
 	}
 }
 
-func (cmd *CleanCommand) Run(args ...string) error {
+func (cmd *CleanCommand) Run(ctx context.Context, args ...string) error {
 	fs := flag.NewFlagSet("clean", flag.ContinueOnError)
 
 	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
 
-	if err := fs.Parse(args); err != nil {
+	if err := parseFlags(fs, args); err != nil {
 		fs.Usage()
 		return err
 	} else if *help {
 		fs.Usage()
 		return nil
 	}
-	return cleanDevices(cmd)
+	return cleanDevices(ctx, cmd)
 }
 
 //cleanDevices delete all devices on thingsboard and remove store file
-func cleanDevices(cmd *CleanCommand) error {
-	store, err := OpenDeviceStore()
+func cleanDevices(ctx context.Context, cmd *CleanCommand) error {
+	store, err := cmd.store.Open()
 	defer func() { _ = store.Close() }()
 	if err != nil {
 		return err
@@ -589,28 +923,62 @@ func cleanDevices(cmd *CleanCommand) error {
 		return err
 	}
 
-	fmt.Fprintf(cmd.Stdout, "%+v\n", info)
+	fmt.Fprintf(cmd.Stdout, "%+v\n", info.redacted())
 
-	var user *TenantUser
-	if user, err = NewTenantUser(info.ServerHost, info.Username, info.Password); err != nil {
+	//devices saved beyond DeviceNum by an interrupted scale are deleted as well
+	devices, err := store.ListDevices(info.namePrefix())
+	if err != nil {
 		return err
 	}
 
-	if err = user.Login(); err != nil {
+	owned := make([]*Device, 0, len(devices))
+	for _, device := range devices {
+		if device.External {
+			fmt.Fprintf(cmd.Stdout, "device[%s] imported, kept on thingsboard\n", device.Name)
+			continue
+		}
+		owned = append(owned, device)
+	}
+
+	//a workspace of imported devices, e.g. of a csv without -serverHost, has nothing to delete on thingsboard
+	deleteProfile := info.CreateProfile && !info.Imported && len(info.DeviceProfileId) > 0
+	if len(owned) == 0 && !deleteProfile {
+		return store.Drop()
+	}
+
+	user, err := info.tenantUser(ctx, promptPassword(cmd.Stdin, cmd.Stderr))
+	if err != nil {
 		return err
 	}
 
-	if err = info.forEach(func(info *InitCommandInfo, index int, deviceName string) error {
-		device, err2 := store.GetDevice(deviceName)
-		if err2 != nil {
-			return err2
+	for _, device := range owned {
+		fmt.Fprintf(cmd.Stdout, "to del device=%+v\n", device)
+
+		//devices provisioned over mqtt are stored without id
+		if len(device.Id) == 0 {
+			found, err := user.GetDevice(ctx, device.Name)
+			if err != nil {
+				return err
+			} else if len(found.Id) == 0 {
+				fmt.Fprintf(cmd.Stdout, "device[%s] already deleted\n", device.Name)
+				continue
+			}
+			device.Id = found.Id
 		}
 
-		fmt.Fprintf(cmd.Stdout, "to del device=%+v\n", device)
+		if err = user.DeleteDevice(ctx, device.Id); IsNotFound(err) {
+			fmt.Fprintf(cmd.Stdout, "device[%s] already deleted\n", device.Name)
+		} else if err != nil {
+			return err
+		}
+	}
 
-		return user.DeleteDevice(device.Id)
-	}); err != nil {
-		return err
+	if deleteProfile {
+		if err = user.DeleteDeviceProfile(ctx, info.DeviceProfileId); IsNotFound(err) {
+			fmt.Fprintf(cmd.Stdout, "device profile[%s] already deleted\n", info.DeviceProfile)
+		} else if err != nil {
+			return err
+		}
 	}
 
 	//delete store
@@ -629,10 +997,17 @@ Usage:
 The commands are:
 
     clean       delete all devices 
+    export      write the devices in store to a json or csv file
+    fake-broker run a mqtt broker with injected faults for devices in store
+    fake-server run an in-memory thingsboard rest api to try tbload
     info        print key/value pair in store
     init        create devices
     help        print this screen
+    import      load devices from a json or csv file, also ones tbload never created
+    query       load the rest read path like dashboards
     run         connect devices and publish messages  
+    subscribe   open websocket telemetry subscriptions like dashboards
+    verify      check the telemetry of the last run was persisted
 
 Use "tbload [command] -h" for more information about a command.
 `, "\n")
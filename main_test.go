@@ -1,54 +1,428 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+//initFakeServer runs init against a FakeServer with args appended, the store is removed when the test ends
+func initFakeServer(t *testing.T, args ...string) *FakeServer {
+	server := NewFakeServer(FakeUsername, FakePassword)
+	t.Cleanup(func() {
+		server.Close()
+		_ = os.Remove(DbFileName)
+	})
+
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	args = append([]string{"init", "-serverHost", server.URL, "-username", FakeUsername, "-password", FakePassword}, args...)
+	if err := main.Run(context.Background(), args...); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
 func TestInitCommand_Run(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "3", "-workers", "2")
+
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := store.ListDevices(DeviceNamePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 3 {
+		t.Fatalf("expected 3 devices, got %d", len(devices))
+	}
+
+	for _, device := range devices {
+		created, ok := server.device(device.Name)
+		if !ok || created.Id.Id != device.Id || created.token != device.AuthToken {
+			t.Fatalf("device %+v not created on server", device)
+		}
+	}
+}
+
+func TestInitCommand_Config(t *testing.T) {
+	server := NewFakeServer(FakeUsername, FakePassword)
+	t.Cleanup(func() {
+		server.Close()
+		_ = os.Remove(DbFileName)
+	})
+
+	//the password comes from the environment, the rest from the file
+	path := writeConfig(t, "tbload.yaml", fmt.Sprintf("init:\n  serverHost: %s\n  username: %s\n  deviceNum: 2\n", server.URL, FakeUsername))
+	setEnv(t, "TBLOAD_PASSWORD", FakePassword)
+
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	if err := main.Run(context.Background(), "init", "-config", path); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := store.ListDevices(DeviceNamePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devices))
+	}
+}
+
+func TestInitCommand_ScaleDown(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "3")
+
+	//devices provisioned over mqtt are stored without id
+	store, err := OpenDeviceStore(DbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := store.ListDevices(DeviceNamePrefix)
+	for _, device := range devices {
+		device.Id = ""
+		if err == nil {
+			err = store.SaveDevice(device)
+		}
+	}
+	_ = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	main := NewMain()
-	args := []string{"init", "-serverHost", "http://www.enniot.net", "-username", "alenym@163.com", "-password", "123456", "-deviceNum", "1"}
-	if err := main.Run(args...); err != nil {
+	main.Stdout = ioutil.Discard
+	if err = main.Run(context.Background(), "init", "-scaleTo", "1"); err != nil {
 		t.Fatal(err)
 	}
+
+	for i, kept := range []bool{true, false, false} {
+		if _, ok := server.device(DeviceNamePrefix + "_" + strconv.Itoa(i)); ok != kept {
+			t.Fatalf("device %d on thingsboard: %v", i, ok)
+		}
+	}
+	if info, devices, err := loadDevices(StoreFlags{}); err != nil || info.DeviceNum != 1 || len(devices) != 1 {
+		t.Fatalf("unexpected store %+v %d devices %v", info, len(devices), err)
+	}
 }
 
 func TestRunCommand_Run(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "3")
+	broker := startFakeBroker(t, FakeBrokerOptions{Latency: time.Millisecond})
+	broker.Authenticate = server.Authenticate
+	broker.OnPublish = server.HandlePublish
+
+	//every message must arrive on the websocket and be persisted
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	args := []string{"run", "-brokerUrl", broker.URL(), "-concurrent", "3", "-messageNum", "20", "-timeout", "10", "-ingestSample", "1", "-verify"}
+	if err := main.Run(context.Background(), args...); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := store.GetSummary(KeySummary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Completed != 3 || summary.PubackLatency.Samples != 60 || summary.IngestLatency.Samples != 20 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	if stats := broker.Stats(); stats.Published != 60 || stats.Acked != 60 {
+		t.Fatalf("unexpected broker stats %+v", stats)
+	}
+}
+
+func TestRunCommand_StoreUnlocked(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "1")
+	broker := startFakeBroker(t, FakeBrokerOptions{Latency: 300 * time.Millisecond})
+	broker.Authenticate = server.Authenticate
+
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	done := make(chan error, 1)
+	go func() {
+		done <- main.Run(context.Background(), "run", "-brokerUrl", broker.URL(), "-messageNum", "6")
+	}()
+
+	//the other commands open the store while run publishes
+	for broker.Stats().Published == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, devices, err := loadDevices(StoreFlags{}); err != nil || len(devices) != 1 {
+		t.Fatalf("store not opened while running: %d devices %v", len(devices), err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunCommand_ConnectFailed(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "4")
+	broker := startFakeBroker(t, FakeBrokerOptions{RefuseRate: 0.5})
+	broker.Authenticate = server.Authenticate
+	broker.OnPublish = server.HandlePublish
+
+	//the devices which connected publish, the others are reported
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	args := []string{"run", "-brokerUrl", broker.URL(), "-concurrent", "4", "-messageNum", "5", "-timeout", "10"}
+	if err := main.Run(context.Background(), args...); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := store.GetSummary(KeySummary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Completed != 2 || summary.ConnectFailed != 2 || summary.Errors != 2 || summary.MessagesPublished != 10 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestRunCommand_NoneConnected(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "2")
+	broker := startFakeBroker(t, FakeBrokerOptions{RefuseRate: 1})
+	broker.Authenticate = server.Authenticate
+
+	//the run fails, but its summary is saved first
 	main := NewMain()
-	args := []string{"run", "-brokerUrl", "http://localhost:1883", "-timeout", "200"}
-	if err := main.Run(args...); err != nil {
+	main.Stdout = ioutil.Discard
+	args := []string{"run", "-brokerUrl", broker.URL(), "-concurrent", "2", "-messageNum", "5", "-timeout", "10"}
+	if err := main.Run(context.Background(), args...); err == nil || !strings.Contains(err.Error(), "none of 2") {
+		t.Fatalf("expected no device to connect, got %v", err)
+	}
+
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := store.GetSummary(KeySummary)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if summary.ConnectFailed != 2 || summary.Errors != 2 || summary.Completed != 0 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestRunCommand_ReportIntervals(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "1")
+	broker := startFakeBroker(t, FakeBrokerOptions{})
+	broker.Authenticate = server.Authenticate
+
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	for _, report := range []bool{true, false} {
+		args := []string{"run", "-brokerUrl", broker.URL(), "-messageNum", "5", "-reportIntervals=" + strconv.FormatBool(report)}
+		if err := main.Run(context.Background(), args...); err != nil {
+			t.Fatal(err)
+		}
+
+		store, err := OpenDeviceStore(DbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary, err := store.GetSummary(KeySummary)
+		_ = store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reported := len(summary.Intervals) > 0; reported != report {
+			t.Fatalf("-reportIntervals=%v: got %d intervals", report, len(summary.Intervals))
+		}
+	}
 }
 
 func TestCleanCommand_Run(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "2", "-createProfile")
+
 	main := NewMain()
-	args := []string{"clean"}
-	if err := main.Run(args...); err != nil {
+	main.Stdout = ioutil.Discard
+	if err := main.Run(context.Background(), "clean"); err != nil {
 		t.Fatal(err)
 	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := server.device(DeviceNamePrefix + "_" + strconv.Itoa(i)); ok {
+			t.Fatalf("device %d not deleted", i)
+		}
+	}
+
+	server.mu.Lock()
+	profiles := len(server.profiles)
+	server.mu.Unlock()
+	if profiles != 1 {
+		t.Fatalf("expected only the default profile, got %d profiles", profiles)
+	}
+
+	if _, err := os.Stat(DbFileName); !os.IsNotExist(err) {
+		t.Fatalf("expected store removed, got %v", err)
+	}
+}
+
+func TestCleanCommand_Credentials(t *testing.T) {
+	setEnv(t, EnvKey, "key")
+	cases := []struct {
+		credentials string
+		stdin       string
+	}{
+		{CredentialsRefreshToken, ""},
+		{CredentialsEncrypted, ""},
+		{CredentialsNone, FakePassword + "\n"},
+	}
+
+	for _, c := range cases {
+		server := initFakeServer(t, "-deviceNum", "1", "-credentials", c.credentials)
+
+		//the store never holds the password, without refresh token or key clean asks for it
+		data, err := ioutil.ReadFile(DbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), `"password"`) {
+			t.Fatalf("%s: password saved in store", c.credentials)
+		}
+
+		var prompted bytes.Buffer
+		main := NewMain()
+		main.Stdin = strings.NewReader(c.stdin)
+		main.Stdout = ioutil.Discard
+		main.Stderr = &prompted
+		if err = main.Run(context.Background(), "clean"); err != nil {
+			t.Fatalf("%s: %v", c.credentials, err)
+		}
+		if asked := prompted.Len() > 0; asked != (c.credentials == CredentialsNone) {
+			t.Fatalf("%s: unexpected prompt %q", c.credentials, prompted.String())
+		}
+		if _, ok := server.device(DeviceNamePrefix + "_0"); ok {
+			t.Fatalf("%s: device not deleted", c.credentials)
+		}
+	}
 }
 
 func TestInfoCommand_Run(t *testing.T) {
 	main := NewMain()
 	args := []string{"info", "-h"}
-	if err := main.Run(args...); err != nil {
+	if err := main.Run(context.Background(), args...); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestInitCommandInfo_Restore(t *testing.T) {
-	store, err := OpenDeviceStore()
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Drop() }()
 	defer func() { _ = store.Close() }()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var info InitCommandInfo
-	if err = info.Restore(store); err != nil {
+	info := InitCommandInfo{ServerHost: "http://localhost:8080", Username: FakeUsername, DeviceNum: 3, NamePrefix: DeviceNamePrefix}
+	if err = info.Store(store); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored InitCommandInfo
+	if err = restored.Restore(store); err != nil {
 		t.Fatal(err)
 	}
 
-	fmt.Printf("%+v\n", info)
+	if restored != info {
+		t.Fatalf("expected %+v, got %+v", info, restored)
+	}
+}
+
+func TestPublishMessages_Deadline(t *testing.T) {
+	slow := &slowClient{delay: 30 * time.Millisecond}
+	client := &MqttClient{Client: slow, Id: "slow"}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	result := publishMessages(ctx, client, publishOptions{topic: tbPubTopic, messageNum: 1000, encoder: jsonPayload{}, stderr: ioutil.Discard}, &RunStats{})
+	if result.Event != TimeoutExceededEvent {
+		t.Fatalf("expected %s, got %s", TimeoutExceededEvent, result.Event)
+	}
+
+	//no more messages are published once the deadline has passed
+	published := atomic.LoadInt32(&slow.published)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&slow.published); n != published {
+		t.Fatalf("client kept publishing after deadline: %d -> %d", published, n)
+	}
+
+	if result.MessagePublished >= 1000 || int32(result.MessagePublished) > published {
+		t.Fatalf("unexpected published count %d", result.MessagePublished)
+	}
+}
+
+func TestPublishMessages_Interrupted(t *testing.T) {
+	client := &MqttClient{Client: &slowClient{delay: time.Millisecond}, Id: "fast"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result := publishMessages(ctx, client, publishOptions{topic: tbPubTopic, messageNum: 10, encoder: jsonPayload{}, stderr: ioutil.Discard}, &RunStats{})
+	if result.Event != InterruptedEvent || result.Error {
+		t.Fatalf("expected %s without error, got %+v", InterruptedEvent, result)
+	}
+}
 
+func TestPublishMessages_Complete(t *testing.T) {
+	client := &MqttClient{Client: &slowClient{delay: time.Millisecond}, Id: "fast"}
+
+	result := publishMessages(context.Background(), client, publishOptions{topic: tbPubTopic, messageNum: 10, encoder: jsonPayload{}, stderr: ioutil.Discard}, &RunStats{})
+	if result.Event != PublishCompleteEvent || result.MessagePublished != 10 {
+		t.Fatalf("expected 10 messages completed, got %+v", result)
+	}
+}
+
+//failingPayload fails to encode any message
+type failingPayload struct{}
+
+func (failingPayload) Encode(m Telemetry) (string, error) {
+	return "", fmt.Errorf("no schema")
+}
+
+func TestPublishMessages_EncodeError(t *testing.T) {
+	client := &MqttClient{Client: &slowClient{delay: time.Millisecond}, Id: "fast"}
+
+	var stderr bytes.Buffer
+	result := publishMessages(context.Background(), client, publishOptions{topic: tbPubTopic, messageNum: 10, encoder: failingPayload{}, stderr: &stderr}, &RunStats{})
+	if result.Event != PublishFailEvent || !strings.Contains(stderr.String(), "client[fast] encode payload: no schema") {
+		t.Fatalf("unexpected result %+v, stderr %q", result, stderr.String())
+	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsPath        = "/metrics"
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	//upper bounds of the publish latency histogram in seconds
+	latencyBuckets = [...]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+//latencyHistogram is a prometheus style histogram of latencies. It is safe for concurrent use.
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]int64 //the last one counts latencies above all buckets
+	sum    int64                          //nanoseconds
+}
+
+func (h *latencyHistogram) observe(latency time.Duration) {
+	i := 0
+	for ; i < len(latencyBuckets); i++ {
+		if latency.Seconds() <= latencyBuckets[i] {
+			break
+		}
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(latency))
+}
+
+//startMetricsServer serves stats in prometheus text format on addr
+func startMetricsServer(addr string, stats *RunStats) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		stats.WriteMetrics(w)
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(listener) }()
+	return server, nil
+}
+
+//WriteMetrics writes counters and the latency histogram in prometheus text format
+func (s *RunStats) WriteMetrics(w io.Writer) {
+	cur := s.counters()
+
+	writeMetric(w, "tbload_connections_total", "counter", "Successful client connections.", cur.connects)
+	writeMetric(w, "tbload_connected_clients", "gauge", "Clients connected now.", cur.connected)
+	writeMetric(w, "tbload_publishes_total", "counter", "Messages sent to the broker.", cur.published)
+	writeMetric(w, "tbload_acks_total", "counter", "Messages acknowledged by the broker.", cur.acked)
+
+	fmt.Fprintf(w, "# HELP tbload_failures_total Failed connections and publishes by class.\n")
+	fmt.Fprintf(w, "# TYPE tbload_failures_total counter\n")
+	fmt.Fprintf(w, "tbload_failures_total{class=\"connect\"} %d\n", cur.connectFailed)
+	fmt.Fprintf(w, "tbload_failures_total{class=\"publish\"} %d\n", cur.failed)
+	fmt.Fprintf(w, "tbload_failures_total{class=\"timeout\"} %d\n", cur.timedOut)
+
+	writeHistogram(w, "tbload_publish_latency_seconds", "Time from publish to acknowledgement.", &s.histogram)
+	writeHistogram(w, "tbload_ingest_latency_seconds", "Time from publish to arrival on a telemetry subscription.", &s.ingestHistogram)
+}
+
+func writeHistogram(w io.Writer, name, help string, h *latencyHistogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative int64
+	for i, bound := range latencyBuckets {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+	}
+	cumulative += atomic.LoadInt64(&h.counts[len(latencyBuckets)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunStats_WriteMetrics(t *testing.T) {
+	stats := &RunStats{}
+	stats.Connected()
+	stats.Disconnected()
+	stats.Connected()
+	stats.ConnectFailed()
+	stats.Published()
+	stats.Acked(3 * time.Millisecond)
+	stats.Published()
+	stats.Acked(20 * time.Second)
+	stats.Published()
+	stats.TimedOut()
+
+	var out bytes.Buffer
+	stats.WriteMetrics(&out)
+	metrics := out.String()
+
+	for _, line := range []string{
+		"tbload_connections_total 2",
+		"tbload_connected_clients 1",
+		"tbload_publishes_total 3",
+		"tbload_acks_total 2",
+		`tbload_failures_total{class="connect"} 1`,
+		`tbload_failures_total{class="timeout"} 1`,
+		`tbload_publish_latency_seconds_bucket{le="0.0025"} 0`,
+		`tbload_publish_latency_seconds_bucket{le="0.005"} 1`,
+		`tbload_publish_latency_seconds_bucket{le="10"} 1`,
+		`tbload_publish_latency_seconds_bucket{le="+Inf"} 2`,
+		"tbload_publish_latency_seconds_count 2",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, metrics)
+		}
+	}
+}
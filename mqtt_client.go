@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,15 +15,21 @@ const (
 	retained            = false
 	autoReconnect       = true
 	messageChannelDepth = 1000
+	tokenPollInterval   = 50 * time.Millisecond
 )
 
 var (
 	ErrMqttClientConnectTimeout = errors.New("mqtt client connect timeout")
+	ErrConnectionLost           = errors.New("connection lost before publish completed")
 )
 
 type MqttClient struct {
 	mqtt.Client
 	Id string
+
+	lost  int64     //connections lost, updated atomically
+	open  int32     //1 while the connection is counted in stats, updated atomically
+	stats *RunStats //counts connects and disconnects if set
 }
 
 type Connected bool
@@ -32,7 +40,8 @@ type Result struct {
 	Event    string
 	Error    bool
 
-	MessagePublished int
+	MessagePublished int //acknowledged messages
+	MessageSent      int //messages sent, acknowledged or not
 	PublishTime      time.Duration
 	PublishDoneTime  time.Duration
 }
@@ -43,35 +52,86 @@ func NewMqttClient(clientId, username, password, brokerUrl string) *MqttClient {
 		options.SetAutoReconnect(autoReconnect)
 		options.SetMessageChannelDepth(messageChannelDepth)
 	}
-	client := mqtt.NewClient(options)
-	return &MqttClient{client, clientId}
+	client := &MqttClient{Id: clientId}
+	options.SetOnConnectHandler(func(mqtt.Client) {
+		//called for reconnects and the first connect, which ConnectAndWait may have counted already
+		if client.IsConnectionOpen() {
+			client.markConnected()
+		}
+	})
+	options.SetConnectionLostHandler(func(mqtt.Client, error) {
+		atomic.AddInt64(&client.lost, 1)
+		client.markDisconnected()
+	})
+	client.Client = mqtt.NewClient(options)
+	return client
+}
+
+//Close disconnects the client and counts it as disconnected
+func (c *MqttClient) Close() {
+	c.markDisconnected()
+	c.Client.Disconnect(5)
 }
 
-func (c *MqttClient) ConnectAndWait(totalTimeout, connectTimeout time.Duration) (Connected, error) {
-	timer := time.NewTimer(totalTimeout)
-	for retry := true; retry; {
-		select {
-		case <-timer.C:
-			retry = false
-		default:
-			token := c.Connect()
-			connected := token.WaitTimeout(connectTimeout)
-			err := token.Error()
-			if connected && err == nil {
-				return true, nil
-			} else if err != nil {
-				return false, err
-			}
-			fmt.Printf("retry [%s]\n", c.Id)
+//markConnected counts the connection in stats once until it is lost or closed
+func (c *MqttClient) markConnected() {
+	if atomic.CompareAndSwapInt32(&c.open, 0, 1) && c.stats != nil {
+		c.stats.Connected()
+	}
+}
+
+//markDisconnected counts a counted connection as lost or closed
+func (c *MqttClient) markDisconnected() {
+	if atomic.CompareAndSwapInt32(&c.open, 1, 0) && c.stats != nil {
+		c.stats.Disconnected()
+	}
+}
+
+//ConnectAndWait connects to broker and retries every connectTimeout until ctx is done.
+//A connectTimeout of 0 means a single attempt waits until ctx is done.
+func (c *MqttClient) ConnectAndWait(ctx context.Context, connectTimeout time.Duration) (Connected, error) {
+	for {
+		if err := ctx.Err(); err == context.DeadlineExceeded {
+			return false, ErrMqttClientConnectTimeout
+		} else if err != nil {
+			return false, err
+		}
+
+		connected, err := c.connect(ctx, connectTimeout)
+		if connected && err == nil {
+			c.markConnected()
+			return true, nil
+		} else if err != nil {
+			return false, err
 		}
+		fmt.Printf("retry [%s]\n", c.Id)
+	}
+}
+
+//connect makes a single connection attempt bounded by connectTimeout.
+func (c *MqttClient) connect(ctx context.Context, connectTimeout time.Duration) (bool, error) {
+	if connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, connectTimeout)
+		defer cancel()
 	}
-	return false, ErrMqttClientConnectTimeout
+
+	token := c.Connect()
+	connected := waitToken(ctx, token)
+	return connected, token.Error()
 }
 
-func (c *MqttClient) PublishAndWait(topic, payload string, timeout time.Duration) (Published, error) {
+//PublishAndWait publishes payload and waits for the acknowledgement until ctx is done.
+//A publish fails if the connection is lost meanwhile: paho resends the message after it reconnects,
+//but completes the token of the lost connection without an acknowledgement.
+func (c *MqttClient) PublishAndWait(ctx context.Context, topic, payload string) (Published, error) {
+	lost := atomic.LoadInt64(&c.lost)
 	token := c.Publish(topic, qos, retained, payload)
-	published := token.WaitTimeout(timeout)
+	published := waitToken(ctx, token)
 	err := token.Error()
+	if err == nil && atomic.LoadInt64(&c.lost) != lost {
+		err = ErrConnectionLost
+	}
 	if published == false || err != nil {
 		if err != nil {
 			fmt.Printf("err=%s", err)
@@ -81,3 +141,15 @@ func (c *MqttClient) PublishAndWait(topic, payload string, timeout time.Duration
 
 	return true, nil
 }
+
+//waitToken waits until token completes or ctx is done. It returns false if the token did not complete.
+func waitToken(ctx context.Context, token mqtt.Token) bool {
+	for {
+		if token.WaitTimeout(tokenPollInterval) {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+}
@@ -1,27 +1,166 @@
 package main
 
 import (
+	"context"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestNewMqttClient(t *testing.T) {
-	clientId := "dfasfasdfas"
-	brokerUrl := "tcp://139.219.2.82:1883"
-	user := "qvZmJEXmFUAf0lkyuIm6"
-	client := NewMqttClient(clientId, user, "", brokerUrl)
-	_, err := client.ConnectAndWait(5*time.Second, false)
+	token := "qvZmJEXmFUAf0lkyuIm6"
+	broker := startFakeBroker(t, FakeBrokerOptions{}, &Device{Name: "device_0", AuthToken: token})
+
+	client := NewMqttClient("dfasfasdfas", token, "", broker.URL())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.ConnectAndWait(ctx, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer client.Disconnect(0)
 
 	var payload string
 	payload = `{"ts":1451649600512, "values":{"_tbload_key":1.4}}`
 
 	topic := "v1/devices/me/telemetry"
-	_, err = client.PublishAndWait(topic, payload, 5*time.Second)
+	_, err = client.PublishAndWait(ctx, topic, payload)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 }
+
+func TestMqttClient_ConnectedGauge(t *testing.T) {
+	token := "qvZmJEXmFUAf0lkyuIm6"
+	broker := startFakeBroker(t, FakeBrokerOptions{}, &Device{Name: "device_0", AuthToken: token})
+
+	stats := &RunStats{}
+	client := NewMqttClient("device_0", token, "", broker.URL())
+	client.stats = stats
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.ConnectAndWait(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(0)
+
+	//wait for the connect handler, which must not count the connection twice
+	time.Sleep(50 * time.Millisecond)
+	if cur := stats.counters(); cur.connected != 1 || cur.connects != 1 {
+		t.Fatalf("expected 1 connected of 1 connects, got %d of %d", cur.connected, cur.connects)
+	}
+
+	//the broker goes away, the connection is lost and reconnects fail
+	if err := broker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for stats.counters().connected != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection lost is not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.Close()
+	if cur := stats.counters(); cur.connected != 0 || cur.connects != 1 {
+		t.Fatalf("expected 0 connected of 1 connects, got %d of %d", cur.connected, cur.connects)
+	}
+}
+
+func TestMqttClient_CloseCountsDisconnect(t *testing.T) {
+	token := "qvZmJEXmFUAf0lkyuIm6"
+	broker := startFakeBroker(t, FakeBrokerOptions{}, &Device{Name: "device_0", AuthToken: token})
+
+	stats := &RunStats{}
+	client := NewMqttClient("device_0", token, "", broker.URL())
+	client.stats = stats
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.ConnectAndWait(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	if cur := stats.counters(); cur.connected != 0 || cur.connects != 1 {
+		t.Fatalf("expected 0 connected of 1 connects, got %d of %d", cur.connected, cur.connects)
+	}
+}
+
+// slowClient is a mqtt.Client whose publishes are acknowledged after delay
+type slowClient struct {
+	mqtt.Client
+	delay     time.Duration
+	published int32
+}
+
+func (c *slowClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	atomic.AddInt32(&c.published, 1)
+	return newDelayedToken(c.delay)
+}
+
+func (c *slowClient) Connect() mqtt.Token {
+	return newDelayedToken(c.delay)
+}
+
+// delayedToken completes after a delay
+type delayedToken struct {
+	complete chan struct{}
+}
+
+func newDelayedToken(delay time.Duration) *delayedToken {
+	token := &delayedToken{complete: make(chan struct{})}
+	time.AfterFunc(delay, func() { close(token.complete) })
+	return token
+}
+
+func (t *delayedToken) Wait() bool {
+	<-t.complete
+	return true
+}
+
+func (t *delayedToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.complete:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (t *delayedToken) Error() error {
+	return nil
+}
+
+func TestMqttClient_PublishAndWaitDeadline(t *testing.T) {
+	client := &MqttClient{Client: &slowClient{delay: time.Hour}, Id: "slow"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	published, err := client.PublishAndWait(ctx, tbPubTopic, "{}")
+	if published || err == nil {
+		t.Fatal("expected publish to fail after deadline")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publish returned %s after deadline", elapsed)
+	}
+}
+
+func TestMqttClient_ConnectAndWaitDeadline(t *testing.T) {
+	client := &MqttClient{Client: &slowClient{delay: time.Hour}, Id: "slow"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	connected, err := client.ConnectAndWait(ctx, 20*time.Millisecond)
+	if connected {
+		t.Fatal("expected connect to fail after deadline")
+	}
+
+	if err != ErrMqttClientConnectTimeout {
+		t.Fatalf("expected %v, got %v", ErrMqttClientConnectTimeout, err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	ProvisionModeRest = "rest"
+	ProvisionModeMqtt = "mqtt"
+
+	provisionRequestTopic  = "/provision/request"
+	provisionResponseTopic = "/provision/response"
+	provisionUsername      = "provision"
+	provisionTimeout       = 30 * time.Second
+
+	provisionStatusSuccess = "SUCCESS"
+	credentialsAccessToken = "ACCESS_TOKEN"
+)
+
+//ProvisionRequest correspond to the payload of /provision/request
+type ProvisionRequest struct {
+	DeviceName            string `json:"deviceName"`
+	ProvisionDeviceKey    string `json:"provisionDeviceKey"`
+	ProvisionDeviceSecret string `json:"provisionDeviceSecret"`
+}
+
+//ProvisionResponse correspond to the payload of /provision/response
+type ProvisionResponse struct {
+	Status           string `json:"status"`
+	CredentialsType  string `json:"credentialsType"`
+	CredentialsValue string `json:"credentialsValue"`
+	ErrorMsg         string `json:"errorMsg"`
+}
+
+//Provision requests device credentials on a connected anonymous session and waits for the response until ctx is done
+func (c *MqttClient) Provision(ctx context.Context, request ProvisionRequest) (*ProvisionResponse, error) {
+	responses := make(chan []byte, 1)
+	token := c.Subscribe(provisionResponseTopic, qos, func(client mqtt.Client, message mqtt.Message) {
+		select {
+		case responses <- message.Payload():
+		default:
+		}
+	})
+	if !waitToken(ctx, token) {
+		return nil, ctx.Err()
+	} else if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = c.PublishAndWait(ctx, provisionRequestTopic, string(data)); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case payload := <-responses:
+		var response ProvisionResponse
+		if err = json.Unmarshal(payload, &response); err != nil {
+			return nil, fmt.Errorf("provision response %q: %v", string(payload), err)
+		}
+
+		if response.Status != provisionStatusSuccess {
+			return nil, fmt.Errorf("provision %s: %s", response.Status, response.ErrorMsg)
+		} else if response.CredentialsType != credentialsAccessToken {
+			return nil, fmt.Errorf("provision returned %s credentials, only %s is supported", response.CredentialsType, credentialsAccessToken)
+		}
+		return &response, nil
+	}
+}
+
+//mqttProvisioner provisions devices through the mqtt provisioning api and records the latency of every request
+type mqttProvisioner struct {
+	info      *InitCommandInfo
+	newClient func(clientId string) *MqttClient
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+func newMqttProvisioner(info *InitCommandInfo) *mqttProvisioner {
+	return &mqttProvisioner{
+		info: info,
+		newClient: func(clientId string) *MqttClient {
+			return NewMqttClient(clientId, provisionUsername, "", info.BrokerUrl)
+		},
+	}
+}
+
+//provision connects as the device at index, requests its credentials and disconnects
+func (p *mqttProvisioner) provision(ctx context.Context, index int) (*Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, provisionTimeout)
+	defer cancel()
+
+	deviceName := p.info.deviceName(index)
+	client := p.newClient(deviceName)
+	if _, err := client.ConnectAndWait(ctx, 0); err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(0)
+
+	start := time.Now()
+	response, err := client.Provision(ctx, ProvisionRequest{
+		DeviceName:            deviceName,
+		ProvisionDeviceKey:    p.info.Profile.ProvisionDeviceKey,
+		ProvisionDeviceSecret: p.info.Profile.ProvisionDeviceSecret,
+	})
+	if err != nil {
+		return nil, err
+	}
+	latency := time.Since(start)
+
+	p.mu.Lock()
+	p.latencies = append(p.latencies, latency)
+	p.mu.Unlock()
+
+	//the id is unknown until clean looks the device up by name
+	device := &Device{
+		Name:            deviceName,
+		Type:            p.info.DeviceType,
+		AuthToken:       response.CredentialsValue,
+		SeqNo:           index,
+		DeviceProfileId: p.info.DeviceProfileId,
+	}
+	if len(device.AuthToken) == 0 {
+		return device, ErrDeviceAuthTokenEmpty
+	}
+	return device, nil
+}
+
+//printLatencies prints percentiles of the provisioning latencies
+func (p *mqttProvisioner) printLatencies(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.latencies) == 0 {
+		return
+	}
+
+	p50, p90, p99 := percentile(p.latencies, 50), percentile(p.latencies, 90), percentile(p.latencies, 99)
+	//percentile sorts latencies, so the last one is the max
+	fmt.Fprintf(w, "provisioned %d devices over mqtt, latency p50: %s  p90: %s  p99: %s  max: %s\n",
+		len(p.latencies), p50, p90, p99, p.latencies[len(p.latencies)-1])
+}
+
+//provisioner returns provision creating the device at index in the -provisionMode of init, and report printing
+//what was measured while provisioning
+func (cmd *InitCommand) provisioner(user *TenantUser) (provision func(ctx context.Context, index int) (*Device, error), report func()) {
+	info := cmd.info
+	if info.ProvisionMode == ProvisionModeMqtt {
+		p := newMqttProvisioner(&info)
+		return p.provision, func() { p.printLatencies(cmd.Stdout) }
+	}
+
+	return func(ctx context.Context, index int) (*Device, error) {
+		return provisionDevice(ctx, user, &info, index)
+	}, func() {}
+}
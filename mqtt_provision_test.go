@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// provisionClient is a mqtt.Client answering provision requests like thingsboard does
+type provisionClient struct {
+	mqtt.Client
+	key, secret string
+
+	mu      sync.Mutex
+	handler mqtt.MessageHandler
+}
+
+func (c *provisionClient) Connect() mqtt.Token {
+	return newDelayedToken(0)
+}
+
+func (c *provisionClient) Disconnect(quiesce uint) {}
+
+func (c *provisionClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if topic == provisionResponseTopic {
+		c.handler = callback
+	}
+	return newDelayedToken(0)
+}
+
+func (c *provisionClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var request ProvisionRequest
+	_ = json.Unmarshal([]byte(payload.(string)), &request)
+
+	response := ProvisionResponse{Status: "NOT_FOUND", ErrorMsg: "Provision data was not found!"}
+	if request.ProvisionDeviceKey == c.key && request.ProvisionDeviceSecret == c.secret {
+		response = ProvisionResponse{Status: provisionStatusSuccess, CredentialsType: credentialsAccessToken, CredentialsValue: "token-" + request.DeviceName}
+	}
+
+	data, _ := json.Marshal(response)
+	c.mu.Lock()
+	handler := c.handler
+	c.mu.Unlock()
+	go handler(c, &testMessage{topic: provisionResponseTopic, payload: data})
+	return newDelayedToken(0)
+}
+
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Topic() string {
+	return m.topic
+}
+
+func (m *testMessage) Payload() []byte {
+	return m.payload
+}
+
+func TestMqttProvisioner(t *testing.T) {
+	info := &InitCommandInfo{NamePrefix: "load", DeviceType: "default", DeviceProfileId: "profile-id"}
+	info.Profile.ProvisionDeviceKey = "key"
+	info.Profile.ProvisionDeviceSecret = "secret"
+
+	p := newMqttProvisioner(info)
+	p.newClient = func(clientId string) *MqttClient {
+		return &MqttClient{Client: &provisionClient{key: "key", secret: "secret"}, Id: clientId}
+	}
+
+	for i := 0; i < 3; i++ {
+		device, err := p.provision(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if device.Name != info.deviceName(i) || device.AuthToken != "token-"+device.Name || device.SeqNo != i || device.DeviceProfileId != "profile-id" {
+			t.Fatalf("unexpected device %+v", device)
+		}
+	}
+
+	var out bytes.Buffer
+	p.printLatencies(&out)
+	if !strings.HasPrefix(out.String(), "provisioned 3 devices over mqtt") {
+		t.Fatalf("unexpected report %q", out.String())
+	}
+
+	info.Profile.ProvisionDeviceSecret = "wrong"
+	if _, err := p.provision(context.Background(), 3); err == nil || !strings.Contains(err.Error(), "NOT_FOUND") {
+		t.Fatalf("expected NOT_FOUND, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	//telemetry keys of the sequence number and the send time, protobuf payloads carry them in fields named seq and sent
+	jsonSeqKey      = ToolPrefix + "_seq"
+	protobufSeqKey  = "seq"
+	jsonSentKey     = ToolPrefix + "_sent"
+	protobufSentKey = "sent"
+)
+
+//Telemetry is a message generated by a client
+type Telemetry struct {
+	Ts     int64 //milliseconds, 0 leaves the timestamp to thingsboard which stamps every delivery when it arrives
+	Seq    int   //position of the message in the messages of the client
+	Sent   int64 //milliseconds since epoch the message was sent
+	Values map[string]interface{}
+}
+
+//PayloadEncoder encodes a telemetry message
+type PayloadEncoder interface {
+	Encode(m Telemetry) (string, error)
+}
+
+//jsonPayload encodes the ThingsBoard {"ts":ts, "values":{...}} telemetry format, or {...} without ts
+type jsonPayload struct{}
+
+func (jsonPayload) Encode(m Telemetry) (string, error) {
+	values := map[string]interface{}{jsonSeqKey: m.Seq, jsonSentKey: m.Sent}
+	for key, value := range m.Values {
+		values[key] = value
+	}
+
+	if m.Ts == 0 {
+		data, err := json.Marshal(values)
+		return string(data), err
+	}
+
+	data, err := json.Marshal(struct {
+		Ts     int64                  `json:"ts"`
+		Values map[string]interface{} `json:"values"`
+	}{m.Ts, values})
+	return string(data), err
+}
+
+//protobufPayload encodes values with the telemetry schema of the device profile.
+//Fields named ts, seq and sent get the timestamp, the sequence number and the send time.
+type protobufPayload struct {
+	schema *ProtoSchema
+}
+
+func (p protobufPayload) Encode(m Telemetry) (string, error) {
+	values := map[string]interface{}{protobufSeqKey: m.Seq, protobufSentKey: m.Sent}
+	if m.Ts != 0 {
+		values["ts"] = m.Ts
+	}
+	for key, value := range m.Values {
+		values[key] = value
+	}
+
+	data, err := p.schema.Encode(values)
+	return string(data), err
+}
+
+//seqKey returns the telemetry key of sequence numbers sent in format
+func seqKey(format string) string {
+	if strings.ToUpper(format) == PayloadTypeProtobuf {
+		return protobufSeqKey
+	}
+	return jsonSeqKey
+}
+
+//newPayloadEncoder returns the encoder of format, JSON or PROTOBUF with the schema in schemaFile
+func newPayloadEncoder(format, schemaFile string) (PayloadEncoder, error) {
+	switch strings.ToUpper(format) {
+	case PayloadTypeJson:
+		return jsonPayload{}, nil
+	case PayloadTypeProtobuf:
+		schema, err := readProtoSchema(schemaFile)
+		if err != nil {
+			return nil, err
+		}
+		return protobufPayload{schema: schema}, nil
+	}
+	return nil, fmt.Errorf("unknown payload format[%s]", format)
+}
+
+//readProtoSchema reads and parses the .proto file schemaFile
+func readProtoSchema(schemaFile string) (*ProtoSchema, error) {
+	if len(schemaFile) == 0 {
+		return nil, fmt.Errorf("protobuf payload needs a proto schema file")
+	}
+
+	data, err := ioutil.ReadFile(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := ParseProtoSchema(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("proto schema[%s]: %v", schemaFile, err)
+	}
+	return schema, nil
+}
+
+//sentKey returns the telemetry key of send times sent in format
+func sentKey(format string) string {
+	if strings.ToUpper(format) == PayloadTypeProtobuf {
+		return protobufSentKey
+	}
+	return jsonSentKey
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	progressInterval = time.Second
+
+	//latencies sampled for the percentiles of an interval or a run
+	latencySamples = 10000
+)
+
+//RunStats counts events of a running test. It is safe for concurrent use.
+type RunStats struct {
+	connects      int64
+	connected     int64 //clients connected now
+	connectFailed int64
+	published     int64
+	acked         int64
+	failed        int64
+	timedOut      int64
+
+	//cumulative publish and ingest latencies, exported by the metrics endpoint
+	histogram       latencyHistogram
+	ingestHistogram latencyHistogram
+
+	mu        sync.Mutex
+	latencies latencyReservoir //publish latencies of the current interval
+	acks      latencyReservoir //publish latencies of the run
+	ingest    latencyReservoir //ingest latencies of the run
+}
+
+//latencyReservoir keeps a uniform sample of at most latencySamples latencies, and the count and max of all of them
+type latencyReservoir struct {
+	samples []time.Duration
+	count   int
+	max     time.Duration
+}
+
+func (r *latencyReservoir) add(latency time.Duration) {
+	r.count++
+	if latency > r.max {
+		r.max = latency
+	}
+
+	if len(r.samples) < latencySamples {
+		r.samples = append(r.samples, latency)
+	} else if i := rand.Intn(r.count); i < latencySamples {
+		r.samples[i] = latency
+	}
+}
+
+//latency returns the distribution of the latencies added
+func (r *latencyReservoir) latency() Latency {
+	latency := newLatency(append([]time.Duration(nil), r.samples...))
+	latency.Samples = r.count
+	latency.Max = r.max
+	return latency
+}
+
+//Interval is a per-second bucket of RunStats taken by the progress reporter
+type Interval struct {
+	Elapsed    time.Duration
+	Connected  int     //connected clients at the end of the interval
+	Published  int     //messages sent during the interval
+	Acked      int     //messages acknowledged during the interval
+	Failed     int     //messages failed during the interval
+	Throughput float64 //acknowledged msg/sec during the interval
+	LatencyP50 time.Duration
+	LatencyP90 time.Duration
+	LatencyP99 time.Duration
+}
+
+//Connected counts a connection of a client, first or reconnect
+func (s *RunStats) Connected() {
+	atomic.AddInt64(&s.connects, 1)
+	atomic.AddInt64(&s.connected, 1)
+}
+
+//Disconnected counts a client whose connection was lost or closed
+func (s *RunStats) Disconnected() {
+	atomic.AddInt64(&s.connected, -1)
+}
+
+//ConnectFailed counts a client that failed to connect
+func (s *RunStats) ConnectFailed() {
+	atomic.AddInt64(&s.connectFailed, 1)
+}
+
+//Published counts a message sent to the broker
+func (s *RunStats) Published() {
+	atomic.AddInt64(&s.published, 1)
+}
+
+//Acked counts an acknowledged message and its latency
+func (s *RunStats) Acked(latency time.Duration) {
+	atomic.AddInt64(&s.acked, 1)
+	s.histogram.observe(latency)
+	s.mu.Lock()
+	s.latencies.add(latency)
+	s.acks.add(latency)
+	s.mu.Unlock()
+}
+
+//Ingested counts a message seen on a telemetry subscription and its latency from being sent
+func (s *RunStats) Ingested(latency time.Duration) {
+	s.ingestHistogram.observe(latency)
+	s.mu.Lock()
+	s.ingest.add(latency)
+	s.mu.Unlock()
+}
+
+//Latencies returns the distributions of the publish and the ingest latencies of the run
+func (s *RunStats) Latencies() (puback, ingest Latency) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acks.latency(), s.ingest.latency()
+}
+
+//Failed counts a message that was rejected or not acknowledged by the broker
+func (s *RunStats) Failed() {
+	atomic.AddInt64(&s.failed, 1)
+}
+
+//TimedOut counts a message that was not acknowledged before the run timeout
+func (s *RunStats) TimedOut() {
+	atomic.AddInt64(&s.timedOut, 1)
+}
+
+//takeLatencies returns the latency of the current interval and starts a new one
+func (s *RunStats) takeLatencies() Latency {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latency := s.latencies.latency()
+	s.latencies = latencyReservoir{}
+	return latency
+}
+
+//counters is a point-in-time copy of the RunStats counters
+type counters struct {
+	connects, connected, connectFailed, published, acked, failed, timedOut int64
+}
+
+func (s *RunStats) counters() counters {
+	return counters{
+		connects:      atomic.LoadInt64(&s.connects),
+		connected:     atomic.LoadInt64(&s.connected),
+		connectFailed: atomic.LoadInt64(&s.connectFailed),
+		published:     atomic.LoadInt64(&s.published),
+		acked:         atomic.LoadInt64(&s.acked),
+		failed:        atomic.LoadInt64(&s.failed),
+		timedOut:      atomic.LoadInt64(&s.timedOut),
+	}
+}
+
+//StartProgress prints a progress line to w every interval until the returned stop is called.
+//stop returns all intervals recorded, including the last partial one.
+func (s *RunStats) StartProgress(w io.Writer, interval time.Duration, clients int) (stop func() []Interval) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	finished := make(chan []Interval)
+
+	go func() {
+		var intervals []Interval
+		start := time.Now()
+		last := start
+		var prev counters
+
+		record := func(now time.Time) (Interval, counters) {
+			cur := s.counters()
+			latency := s.takeLatencies()
+			iv := Interval{
+				Elapsed:    now.Sub(start),
+				Connected:  int(cur.connected),
+				Published:  int(cur.published - prev.published),
+				Acked:      int(cur.acked - prev.acked),
+				Failed:     int(cur.failed + cur.timedOut - prev.failed - prev.timedOut),
+				Throughput: float64(cur.acked-prev.acked) / now.Sub(last).Seconds(),
+				LatencyP50: latency.P50,
+				LatencyP90: latency.P90,
+				LatencyP99: latency.P99,
+			}
+			intervals = append(intervals, iv)
+			last = now
+			prev = cur
+			return iv, cur
+		}
+
+		for {
+			select {
+			case now := <-ticker.C:
+				iv, cur := record(now)
+				fmt.Fprintf(w, "[%5.0fs] connected: %d/%d  published: %d  rate: %.0f msg/sec  errors: %d  p99: %s\n",
+					iv.Elapsed.Seconds(), cur.connected, clients, cur.published, iv.Throughput, cur.connectFailed+cur.failed+cur.timedOut, iv.LatencyP99)
+			case <-done:
+				ticker.Stop()
+				if now := time.Now(); now.Sub(last) > 0 {
+					record(now)
+				}
+				finished <- intervals
+				return
+			}
+		}
+	}()
+
+	return func() []Interval {
+		close(done)
+		return <-finished
+	}
+}
+
+//percentile returns the p-th percentile of latencies, latencies will be sorted.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	sortLatencies(latencies)
+	return sortedPercentile(latencies, p)
+}
+
+func sortLatencies(latencies []time.Duration) {
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+}
+
+//sortedPercentile returns the p-th percentile of latencies sorted already
+func sortedPercentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	index := int(math.Ceil(float64(len(latencies))*p/100)) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(latencies) {
+		index = len(latencies) - 1
+	}
+	return latencies[index]
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	if p := percentile(latencies, 99); p != 99*time.Millisecond {
+		t.Fatalf("expected p99 99ms, got %s", p)
+	}
+
+	if p := percentile(latencies, 50); p != 50*time.Millisecond {
+		t.Fatalf("expected p50 50ms, got %s", p)
+	}
+
+	if p := percentile(nil, 99); p != 0 {
+		t.Fatalf("expected 0 for no latencies, got %s", p)
+	}
+}
+
+func TestLatencyReservoir(t *testing.T) {
+	var r latencyReservoir
+	n := 3 * latencySamples
+	for i := 1; i <= n; i++ {
+		r.add(time.Duration(i) * time.Millisecond)
+	}
+
+	//memory stays bounded while the count and max cover every latency
+	latency := r.latency()
+	if len(r.samples) != latencySamples || latency.Samples != n || latency.Max != time.Duration(n)*time.Millisecond {
+		t.Fatalf("unexpected %d samples of %+v", len(r.samples), latency)
+	}
+	if p50 := latency.P50 / time.Millisecond; p50 < time.Duration(n)*45/100 || p50 > time.Duration(n)*55/100 {
+		t.Fatalf("expected p50 near %dms, got %s", n/2, latency.P50)
+	}
+}
+
+func TestRunStats_StartProgress(t *testing.T) {
+	var out bytes.Buffer
+	stats := &RunStats{}
+	stop := stats.StartProgress(&out, 20*time.Millisecond, 1)
+
+	stats.Connected()
+	for i := 0; i < 10; i++ {
+		stats.Published()
+		stats.Acked(time.Millisecond)
+	}
+	stats.Published()
+	stats.Failed()
+	time.Sleep(50 * time.Millisecond)
+
+	intervals := stop()
+	if len(intervals) == 0 {
+		t.Fatal("expected intervals")
+	}
+
+	var published, acked, failed int
+	for _, iv := range intervals {
+		published += iv.Published
+		acked += iv.Acked
+		failed += iv.Failed
+	}
+	if published != 11 || acked != 10 || failed != 1 {
+		t.Fatalf("unexpected buckets %+v", intervals)
+	}
+
+	if last := intervals[len(intervals)-1]; last.Connected != 1 {
+		t.Fatalf("unexpected interval %+v", last)
+	}
+
+	if !strings.Contains(out.String(), "connected: 1/1") {
+		t.Fatalf("unexpected progress output %q", out.String())
+	}
+}
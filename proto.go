@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	//nested messages deeper than this are left empty, so recursive types terminate
+	maxProtoDepth = 8
+)
+
+var (
+	ErrProtoNoMessage = errors.New("proto schema has no message")
+)
+
+//ProtoSchema is a .proto file parsed at runtime, messages are encoded without generated code.
+//Only the first top level message is encoded, as ThingsBoard does for telemetry schemas.
+type ProtoSchema struct {
+	pkg      string
+	messages map[string]*protoMessage
+	enums    map[string]*protoEnum
+	order    []*protoMessage //top level messages in declaration order
+}
+
+type protoMessage struct {
+	name   string //full name without package
+	fields []*protoField
+}
+
+type protoField struct {
+	name     string
+	number   int
+	typeName string
+	repeated bool
+	scope    string //full name of the declaring message, used to resolve typeName
+
+	message *protoMessage
+	enum    *protoEnum
+}
+
+type protoEnum struct {
+	name   string
+	values []int64
+}
+
+//ParseProtoSchema parses a proto2 or proto3 file. Services, options and extensions are skipped, map fields are
+//not supported.
+func ParseProtoSchema(src string) (*ProtoSchema, error) {
+	tokens, err := tokenizeProto(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &protoParser{
+		tokens: tokens,
+		schema: &ProtoSchema{messages: make(map[string]*protoMessage), enums: make(map[string]*protoEnum)},
+	}
+	if err = p.parse(); err != nil {
+		return nil, err
+	}
+
+	schema := p.schema
+	if len(schema.order) == 0 {
+		return nil, ErrProtoNoMessage
+	}
+
+	for _, message := range schema.messages {
+		for _, field := range message.fields {
+			if _, ok := protoScalarWireType(field.typeName); ok {
+				continue
+			}
+
+			field.message, field.enum = schema.lookup(field.scope, field.typeName)
+			if field.message == nil && field.enum == nil {
+				return nil, fmt.Errorf("proto field[%s.%s] has unknown type[%s]", message.name, field.name, field.typeName)
+			}
+		}
+	}
+	return schema, nil
+}
+
+//MessageName returns the name of the message encoded by the schema
+func (s *ProtoSchema) MessageName() string {
+	return s.order[0].name
+}
+
+//Encode encodes values in the wire format of the schema message. Fields are looked up in values by name,
+//nested messages by a map[string]interface{}; fields without a value are filled with a generated one.
+func (s *ProtoSchema) Encode(values map[string]interface{}) ([]byte, error) {
+	return s.order[0].encode(nil, values, 0)
+}
+
+//lookup resolves typeName the way protoc does, from the innermost scope outwards
+func (s *ProtoSchema) lookup(scope, typeName string) (*protoMessage, *protoEnum) {
+	if strings.HasPrefix(typeName, ".") {
+		typeName = strings.TrimPrefix(typeName[1:], s.pkg+".")
+		scope = ""
+	} else if len(s.pkg) > 0 && strings.HasPrefix(typeName, s.pkg+".") {
+		typeName = strings.TrimPrefix(typeName, s.pkg+".")
+		scope = ""
+	}
+
+	for {
+		name := typeName
+		if len(scope) > 0 {
+			name = scope + "." + typeName
+		}
+
+		if message, ok := s.messages[name]; ok {
+			return message, nil
+		} else if enum, ok := s.enums[name]; ok {
+			return nil, enum
+		}
+
+		if len(scope) == 0 {
+			return nil, nil
+		}
+
+		if i := strings.LastIndex(scope, "."); i >= 0 {
+			scope = scope[:i]
+		} else {
+			scope = ""
+		}
+	}
+}
+
+func (m *protoMessage) encode(buf []byte, values map[string]interface{}, depth int) ([]byte, error) {
+	for _, field := range m.fields {
+		value, ok := values[field.name]
+		if field.message != nil {
+			nested, _ := value.(map[string]interface{})
+			if !ok && depth >= maxProtoDepth {
+				continue
+			}
+
+			data, err := field.message.encode(nil, nested, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			buf = appendProtoTag(buf, field.number, wireBytes)
+			buf = appendProtoVarint(buf, uint64(len(data)))
+			buf = append(buf, data...)
+			continue
+		}
+
+		if !ok {
+			value = field.generate()
+		}
+
+		var err error
+		if buf, err = field.encode(buf, value); err != nil {
+			return nil, fmt.Errorf("proto field[%s.%s]: %v", m.name, field.name, err)
+		}
+	}
+	return buf, nil
+}
+
+//generate returns the value of a field missing in values
+func (f *protoField) generate() interface{} {
+	switch f.typeName {
+	case "double", "float":
+		return 1.4
+	case "string", "bytes":
+		return ToolPrefix
+	case "bool":
+		return true
+	}
+
+	if f.enum != nil {
+		if len(f.enum.values) == 0 {
+			return int64(0)
+		}
+		return f.enum.values[0]
+	}
+	return int64(1)
+}
+
+//encode appends value, repeated scalars are packed as proto3 does by default
+func (f *protoField) encode(buf []byte, value interface{}) ([]byte, error) {
+	wireType, _ := protoScalarWireType(f.typeName)
+	if f.enum != nil {
+		wireType = wireVarint
+	}
+
+	data, err := f.encodeValue(nil, value)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.repeated && wireType != wireBytes {
+		buf = appendProtoTag(buf, f.number, wireBytes)
+		buf = appendProtoVarint(buf, uint64(len(data)))
+	} else {
+		buf = appendProtoTag(buf, f.number, wireType)
+	}
+	return append(buf, data...), nil
+}
+
+func (f *protoField) encodeValue(buf []byte, value interface{}) ([]byte, error) {
+	switch f.typeName {
+	case "double":
+		v, err := protoFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoFixed64(buf, math.Float64bits(v)), nil
+	case "float":
+		v, err := protoFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoFixed32(buf, math.Float32bits(float32(v))), nil
+	case "fixed64", "sfixed64":
+		v, err := protoInt(value)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoFixed64(buf, uint64(v)), nil
+	case "fixed32", "sfixed32":
+		v, err := protoInt(value)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoFixed32(buf, uint32(v)), nil
+	case "sint32", "sint64":
+		v, err := protoInt(value)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoVarint(buf, uint64(v<<1)^uint64(v>>63)), nil
+	case "bool":
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a bool", value)
+		}
+		if v {
+			return appendProtoVarint(buf, 1), nil
+		}
+		return appendProtoVarint(buf, 0), nil
+	case "string", "bytes":
+		var data []byte
+		switch v := value.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		default:
+			data = []byte(fmt.Sprint(v))
+		}
+		buf = appendProtoVarint(buf, uint64(len(data)))
+		return append(buf, data...), nil
+	}
+
+	//int32, int64, uint32, uint64 and enums, negative int32 are sign extended to ten bytes
+	v, err := protoInt(value)
+	if err != nil {
+		return nil, err
+	}
+	return appendProtoVarint(buf, uint64(v)), nil
+}
+
+//protoScalarWireType returns the wire type of a scalar type name
+func protoScalarWireType(typeName string) (int, bool) {
+	switch typeName {
+	case "int32", "int64", "uint32", "uint64", "sint32", "sint64", "bool":
+		return wireVarint, true
+	case "double", "fixed64", "sfixed64":
+		return wireFixed64, true
+	case "float", "fixed32", "sfixed32":
+		return wireFixed32, true
+	case "string", "bytes":
+		return wireBytes, true
+	}
+	return 0, false
+}
+
+func protoFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+func protoInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int32:
+		return int64(v), nil
+	case uint64:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%v is not an integer", value)
+}
+
+func appendProtoTag(buf []byte, number, wireType int) []byte {
+	return appendProtoVarint(buf, uint64(number)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendProtoFixed64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendProtoFixed32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+//tokenizeProto splits src into identifiers, numbers, quoted strings and punctuation, comments are dropped
+func tokenizeProto(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			if end := strings.IndexByte(src[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(src)
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("proto schema has an unterminated comment")
+			}
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, errors.New("proto schema has an unterminated string")
+			}
+			tokens = append(tokens, src[i:j+1])
+			i = j + 1
+		case isProtoWordChar(rune(c)):
+			j := i
+			for j < len(src) && isProtoWordChar(rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func isProtoWordChar(c rune) bool {
+	return c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.' || c == '-' || c == '+')
+}
+
+type protoParser struct {
+	tokens []string
+	pos    int
+	schema *ProtoSchema
+}
+
+func (p *protoParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *protoParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *protoParser) expect(token string) error {
+	if got := p.next(); got != token {
+		return fmt.Errorf("proto schema: expected %q, got %q", token, got)
+	}
+	return nil
+}
+
+//skipStatement skips to the end of a statement or of the block it opens
+func (p *protoParser) skipStatement() {
+	depth := 0
+	for token := p.next(); len(token) > 0; token = p.next() {
+		switch token {
+		case "{":
+			depth++
+		case "}":
+			if depth--; depth <= 0 {
+				return
+			}
+		case ";":
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+func (p *protoParser) parse() error {
+	for len(p.peek()) > 0 {
+		switch token := p.next(); token {
+		case "package":
+			p.schema.pkg = p.next()
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "message":
+			message, err := p.parseMessage("")
+			if err != nil {
+				return err
+			}
+			p.schema.order = append(p.schema.order, message)
+		case "enum":
+			if err := p.parseEnum(""); err != nil {
+				return err
+			}
+		case ";":
+		default:
+			//syntax, import, option, service and extend
+			p.skipStatement()
+		}
+	}
+	return nil
+}
+
+func (p *protoParser) parseMessage(scope string) (*protoMessage, error) {
+	name := p.next()
+	if len(scope) > 0 {
+		name = scope + "." + name
+	}
+
+	message := &protoMessage{name: name}
+	if _, ok := p.schema.messages[name]; ok {
+		return nil, fmt.Errorf("proto message[%s] is declared twice", name)
+	}
+	p.schema.messages[name] = message
+
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	for {
+		switch token := p.next(); token {
+		case "}":
+			return message, nil
+		case "":
+			return nil, fmt.Errorf("proto message[%s] is not closed", name)
+		case ";":
+		case "message":
+			if _, err := p.parseMessage(name); err != nil {
+				return nil, err
+			}
+		case "enum":
+			if err := p.parseEnum(name); err != nil {
+				return nil, err
+			}
+		case "option", "reserved", "extensions", "extend":
+			p.skipStatement()
+		case "map":
+			return nil, fmt.Errorf("proto message[%s]: map fields are not supported", name)
+		case "oneof":
+			p.next()
+			if err := p.expect("{"); err != nil {
+				return nil, err
+			}
+			for p.peek() != "}" && len(p.peek()) > 0 {
+				if token = p.next(); token == "option" {
+					p.skipStatement()
+				} else if err := p.parseField(message, token, false); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+		case "optional", "required":
+			if err := p.parseField(message, p.next(), false); err != nil {
+				return nil, err
+			}
+		case "repeated":
+			if err := p.parseField(message, p.next(), true); err != nil {
+				return nil, err
+			}
+		default:
+			if err := p.parseField(message, token, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseField(message *protoMessage, typeName string, repeated bool) error {
+	field := &protoField{name: p.next(), typeName: typeName, repeated: repeated, scope: message.name}
+	if err := p.expect("="); err != nil {
+		return err
+	}
+
+	number, err := strconv.Atoi(p.next())
+	if err != nil {
+		return fmt.Errorf("proto field[%s.%s]: %v", message.name, field.name, err)
+	}
+	field.number = number
+
+	//field options like [packed = false] do not change the encoding we generate
+	if p.peek() == "[" {
+		for token := p.next(); token != "]"; token = p.next() {
+			if len(token) == 0 {
+				return fmt.Errorf("proto field[%s.%s] has unclosed options", message.name, field.name)
+			}
+		}
+	}
+
+	message.fields = append(message.fields, field)
+	return p.expect(";")
+}
+
+func (p *protoParser) parseEnum(scope string) error {
+	name := p.next()
+	if len(scope) > 0 {
+		name = scope + "." + name
+	}
+
+	enum := &protoEnum{name: name}
+	p.schema.enums[name] = enum
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+
+	for {
+		switch token := p.next(); token {
+		case "}":
+			return nil
+		case "":
+			return fmt.Errorf("proto enum[%s] is not closed", name)
+		case ";":
+		case "option", "reserved":
+			p.skipStatement()
+		default:
+			if err := p.expect("="); err != nil {
+				return err
+			}
+
+			value, err := strconv.ParseInt(p.next(), 0, 64)
+			if err != nil {
+				return fmt.Errorf("proto enum[%s.%s]: %v", name, token, err)
+			}
+			enum.values = append(enum.values, value)
+
+			if p.peek() == "[" {
+				for token = p.next(); token != "]" && len(token) > 0; token = p.next() {
+				}
+			}
+			if err = p.expect(";"); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testProtoSchema = `
+syntax = "proto3";
+package telemetry;
+
+/* battery telemetry */
+message SensorDataReading {
+  optional double temperature = 1;
+  int32 count = 2;
+  sint32 delta = 3;
+  string name = 4 [json_name = "n"]; // trailing comment
+  repeated int32 levels = 5;
+  Inner inner = 6;
+  Status status = 7;
+  int64 ts = 8;
+
+  message Inner {
+    bool ok = 1;
+  }
+  enum Status {
+    UNKNOWN = 0;
+    OK = 1;
+  }
+}
+
+message Unused {
+  string value = 1;
+}
+`
+
+func TestParseProtoSchema(t *testing.T) {
+	schema, err := ParseProtoSchema(testProtoSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := schema.MessageName(); name != "SensorDataReading" {
+		t.Fatalf("expected SensorDataReading, got %s", name)
+	}
+
+	data, err := protobufPayload{schema}.Encode(Telemetry{Ts: 1, Values: map[string]interface{}{
+		"temperature": 21.5,
+		"count":       300,
+		"delta":       -2,
+		"name":        "ab",
+		"levels":      7,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{
+		0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x35, 0x40, //temperature
+		0x10, 0xac, 0x02, //count
+		0x18, 0x03, //delta zigzag encoded
+		0x22, 0x02, 'a', 'b', //name
+		0x2a, 0x01, 0x07, //levels packed
+		0x32, 0x02, 0x08, 0x01, //inner with a generated ok
+		0x38, 0x00, //status
+		0x40, 0x01, //ts
+	}
+	if !bytes.Equal([]byte(data), expected) {
+		t.Fatalf("expected % x, got % x", expected, []byte(data))
+	}
+}
+
+func TestParseProtoSchema_Recursive(t *testing.T) {
+	schema, err := ParseProtoSchema(`message Node { string name = 1; .Node next = 2; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := schema.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) == 0 {
+		t.Fatal("expected a payload")
+	}
+}
+
+func TestParseProtoSchema_Invalid(t *testing.T) {
+	for _, src := range []string{
+		`syntax = "proto3";`,
+		`message A { Missing b = 1; }`,
+		`message A { map<string, int32> b = 1; }`,
+		`message A { int32 b = x; }`,
+		`message A { int32 b = 1;`,
+		`/* message A {}`,
+	} {
+		if _, err := ParseProtoSchema(src); err == nil {
+			t.Fatalf("expected error for %q", src)
+		}
+	}
+}
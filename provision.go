@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxRetries     = 5
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+
+	progressBarWidth = 40
+)
+
+//RateLimiter spaces out events to at most rps per second. It is safe for concurrent use.
+type RateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+//NewRateLimiter returns a RateLimiter, rps <= 0 means no limit and returns nil.
+func NewRateLimiter(rps float64) *RateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+//Wait blocks until the next event is allowed or ctx is done. A nil RateLimiter never blocks.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+//isRetryable reports whether err is a throttled or server side failure
+func isRetryable(err error) bool {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusTooManyRequests ||
+		apiErr.ErrorCode == ErrorCodeTooManyRequests ||
+		apiErr.StatusCode >= 500
+}
+
+//withRetry calls fn until it succeeds, fails with an error which is not retryable or retries are exhausted.
+func withRetry(ctx context.Context, fn func() error) error {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt == maxRetries {
+			return err
+		}
+
+		//full jitter keeps workers from retrying in lockstep
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+//provisionDevice gets the device at index or creates it as described by info, and fetches its authToken
+func provisionDevice(ctx context.Context, user *TenantUser, info *InitCommandInfo, index int) (*Device, error) {
+	deviceName := info.deviceName(index)
+	var device *Device
+	if err := withRetry(ctx, func() (err error) {
+		device, err = user.GetDevice(ctx, deviceName)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(device.Id) == 0 {
+		device = &Device{
+			Name:            deviceName,
+			Type:            info.DeviceType,
+			Label:           info.Label,
+			DeviceProfileId: info.DeviceProfileId,
+		}
+
+		if err := withRetry(ctx, func() error {
+			return user.CreateDevice(ctx, device)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	device.SeqNo = index
+
+	err := withRetry(ctx, func() (err error) {
+		device.AuthToken, err = user.GetDeviceAuthToken(ctx, device.Id)
+		return err
+	})
+	return device, err
+}
+
+//runWorkers calls fn for indexes in order with workers in parallel and draws a progress bar.
+//The first error stops all workers and is returned.
+func runWorkers(ctx context.Context, w io.Writer, indexes []int, workers int, fn func(ctx context.Context, bar *ProgressBar, index int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	var once sync.Once
+
+	bar := NewProgressBar(w, len(indexes))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				if err := fn(ctx, bar, index); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				bar.Add(1)
+			}
+		}()
+	}
+
+FEED:
+	for _, index := range indexes {
+		select {
+		case queue <- index:
+		case <-ctx.Done():
+			break FEED
+		}
+	}
+	close(queue)
+	wg.Wait()
+	bar.Finish()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+//checkpoint keeps info.DeviceNum at the end of the contiguous range of finished indexes.
+//Scaling up finishes indexes upwards from DeviceNum, scaling down downwards from DeviceNum-1.
+type checkpoint struct {
+	store *DeviceStore
+	up    bool
+
+	mu       sync.Mutex
+	info     InitCommandInfo
+	finished map[int]bool
+}
+
+func newCheckpoint(store *DeviceStore, info InitCommandInfo, up bool) *checkpoint {
+	return &checkpoint{store: store, up: up, info: info, finished: make(map[int]bool)}
+}
+
+//commit marks indexes as finished and saves puts, deletes and the advanced info in one transaction
+func (c *checkpoint) commit(indexes []int, puts map[Key]Value, deletes ...Key) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, index := range indexes {
+		c.finished[index] = true
+	}
+
+	if c.up {
+		for c.finished[c.info.DeviceNum] {
+			delete(c.finished, c.info.DeviceNum)
+			c.info.DeviceNum++
+		}
+	} else {
+		for c.finished[c.info.DeviceNum-1] {
+			delete(c.finished, c.info.DeviceNum-1)
+			c.info.DeviceNum--
+		}
+	}
+
+	data, err := c.info.marshal()
+	if err != nil {
+		return err
+	}
+
+	if puts == nil {
+		puts = make(map[Key]Value)
+	}
+	puts[KeyInitCmdInfo] = data
+	return c.store.Update(puts, deletes...)
+}
+
+//scaleUp creates the devices missing in store between info.DeviceNum and scaleTo
+func scaleUp(ctx context.Context, cmd *InitCommand, user *TenantUser, store *DeviceStore, scaleTo int) error {
+	info := cmd.info
+	cp := newCheckpoint(store, info, true)
+
+	//devices saved by an interrupted scale are not requested again
+	var stored, missing []int
+	for i := info.DeviceNum; i < scaleTo; i++ {
+		if value, err := store.Get(Key(info.deviceName(i))); err != nil {
+			return err
+		} else if len(value) > 0 {
+			stored = append(stored, i)
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	if err := cp.commit(stored, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "%d devices already in store, %d to create\n", len(stored), len(missing))
+
+	provision, report := cmd.provisioner(user)
+	defer report()
+
+	return runWorkers(ctx, cmd.Stdout, missing, cmd.workers, func(ctx context.Context, bar *ProgressBar, index int) error {
+		deviceName := info.deviceName(index)
+		device, err := provision(ctx, index)
+		if err == ErrDeviceAuthTokenEmpty {
+			bar.Printf("device[%s] got empty AuthToken\n", deviceName)
+		} else if err != nil {
+			return fmt.Errorf("device[%s]: %v", deviceName, err)
+		}
+
+		data, err := json.Marshal(device)
+		if err != nil {
+			return err
+		}
+		return cp.commit([]int{index}, map[Key]Value{Key(deviceName): data})
+	})
+}
+
+//scaleDown deletes the devices between scaleTo and info.DeviceNum, from the last one
+func scaleDown(ctx context.Context, cmd *InitCommand, user *TenantUser, store *DeviceStore, scaleTo int) error {
+	info := cmd.info
+	cp := newCheckpoint(store, info, false)
+
+	var surplus []int
+	for i := info.DeviceNum - 1; i >= scaleTo; i-- {
+		surplus = append(surplus, i)
+	}
+
+	return runWorkers(ctx, cmd.Stdout, surplus, cmd.workers, func(ctx context.Context, bar *ProgressBar, index int) error {
+		deviceName := info.deviceName(index)
+		value, err := store.Get(Key(deviceName))
+		if err != nil {
+			return err
+		}
+
+		var device Device
+		if len(value) > 0 {
+			if err = json.Unmarshal(value, &device); err != nil {
+				return err
+			}
+		}
+
+		if len(value) > 0 && !device.External {
+			err = withRetry(ctx, func() error {
+				//devices provisioned over mqtt are stored without id
+				id, err := deviceId(ctx, user, &device)
+				if err != nil {
+					return err
+				}
+				return user.DeleteDevice(ctx, id)
+			})
+			if err != nil && !IsNotFound(err) {
+				return fmt.Errorf("device[%s]: %v", deviceName, err)
+			}
+		}
+
+		return cp.commit([]int{index}, nil, Key(deviceName))
+	})
+}
+
+//ProgressBar draws the progress of n tasks on a single line. It is safe for concurrent use.
+type ProgressBar struct {
+	w     io.Writer
+	total int
+	start time.Time
+
+	mu   sync.Mutex
+	done int
+	last time.Time
+}
+
+func NewProgressBar(w io.Writer, total int) *ProgressBar {
+	return &ProgressBar{w: w, total: total, start: time.Now()}
+}
+
+//Add marks n tasks as done, the bar is redrawn at most ten times a second
+func (b *ProgressBar) Add(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.done += n
+	if now := time.Now(); now.Sub(b.last) >= 100*time.Millisecond || b.done == b.total {
+		b.last = now
+		b.draw()
+	}
+}
+
+//Printf prints a message above the bar
+func (b *ProgressBar) Printf(format string, a ...interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fmt.Fprintf(b.w, "\r%s\r", strings.Repeat(" ", progressBarWidth+40))
+	fmt.Fprintf(b.w, format, a...)
+	b.draw()
+}
+
+//Finish ends the line of the bar
+func (b *ProgressBar) Finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.draw()
+	fmt.Fprintln(b.w)
+}
+
+func (b *ProgressBar) draw() {
+	ratio := 1.0
+	if b.total > 0 {
+		ratio = float64(b.done) / float64(b.total)
+	}
+	filled := int(ratio * progressBarWidth)
+	rate := float64(b.done) / time.Since(b.start).Seconds()
+
+	fmt.Fprintf(b.w, "\r[%s%s] %d/%d (%.0f%%) %.1f/s",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), b.done, b.total, ratio*100, rate)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	limiter := NewRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the first event passes at once, the other 10 are spaced 10ms apart
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected at least 90ms, got %s", elapsed)
+	}
+
+	if NewRateLimiter(0) != nil {
+		t.Fatal("expected no limiter for rps 0")
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	var calls int
+	err := withRetry(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return &APIError{StatusCode: http.StatusTooManyRequests}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success after 3 calls, got %d calls, %v", calls, err)
+	}
+
+	calls = 0
+	err = withRetry(context.Background(), func() error {
+		calls++
+		return &APIError{StatusCode: http.StatusBadRequest}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("expected bad request not to be retried, got %d calls, %v", calls, err)
+	}
+}
+
+func TestProvisionDevice(t *testing.T) {
+	var throttled int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case loginEnding:
+			_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+		case "/api/tenant/devices":
+			//the existing device is only found after being throttled once
+			if atomic.AddInt32(&throttled, 1) == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(TBDevice{Id: EntityId{Id: "device-id"}, Name: r.URL.Query().Get("deviceName")})
+		case "/api/device/device-id/credentials":
+			_ = json.NewEncoder(w).Encode(Credential{CredentialsId: "auth-token"})
+		}
+	}))
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := provisionDevice(context.Background(), user, &InitCommandInfo{}, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.Id != "device-id" || device.AuthToken != "auth-token" || device.SeqNo != 7 || device.Name != DeviceNamePrefix+"_7" {
+		t.Fatalf("unexpected device %+v", device)
+	}
+}
+
+func TestCheckpoint_Commit(t *testing.T) {
+	store, err := OpenDeviceStore(DbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = store.Close()
+		_ = store.Drop()
+	}()
+
+	info := InitCommandInfo{DeviceNum: 2}
+	cp := newCheckpoint(store, info, true)
+
+	deviceNum := func() int {
+		var restored InitCommandInfo
+		if err := restored.Restore(store); err != nil {
+			t.Fatal(err)
+		}
+		return restored.DeviceNum
+	}
+
+	//index 3 finishes before 2, the checkpoint waits for 2
+	if err = cp.commit([]int{3}, map[Key]Value{Key(info.deviceName(3)): Value(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := deviceNum(); n != 2 {
+		t.Fatalf("expected deviceNum 2, got %d", n)
+	}
+
+	if err = cp.commit([]int{2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := deviceNum(); n != 4 {
+		t.Fatalf("expected deviceNum 4, got %d", n)
+	}
+
+	//scaling down removes devices from the end
+	cp = newCheckpoint(store, InitCommandInfo{DeviceNum: 4}, false)
+	if err = cp.commit([]int{3}, nil, Key(info.deviceName(3))); err != nil {
+		t.Fatal(err)
+	}
+	if n := deviceNum(); n != 3 {
+		t.Fatalf("expected deviceNum 3, got %d", n)
+	}
+
+	if value, _ := store.Get(Key(info.deviceName(3))); len(value) > 0 {
+		t.Fatalf("expected device 3 deleted, got %s", value)
+	}
+}
+
+func TestProvisionDevice_Custom(t *testing.T) {
+	var created SaveDeviceRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case loginEnding:
+			_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+		case "/api/tenant/devices":
+			w.WriteHeader(http.StatusNotFound)
+		case saveDeviceEnding:
+			_ = json.NewDecoder(r.Body).Decode(&created)
+			_ = json.NewEncoder(w).Encode(TBDevice{Id: EntityId{Id: "device-id"}, Name: created.DeviceName, Label: created.Label})
+		case "/api/device/device-id/credentials":
+			_ = json.NewEncoder(w).Encode(Credential{CredentialsId: "auth-token"})
+		}
+	}))
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &InitCommandInfo{NamePrefix: "alice", DeviceType: "battery", Label: "soak", DeviceProfileId: "profile-id"}
+	device, err := provisionDevice(context.Background(), user, info, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created.DeviceName != "alice_3" || created.DeviceType != "battery" || created.Label != "soak" {
+		t.Fatalf("unexpected create request %+v", created)
+	}
+
+	if created.DeviceProfileId == nil || created.DeviceProfileId.Id != "profile-id" || created.DeviceProfileId.EntityType != entityTypeDeviceProfile {
+		t.Fatalf("unexpected device profile %+v", created.DeviceProfileId)
+	}
+
+	if device.SeqNo != 3 || device.Label != "soak" {
+		t.Fatalf("unexpected device %+v", device)
+	}
+}
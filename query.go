@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EndpointLatest     = "latest"
+	EndpointTimeseries = "timeseries"
+	EndpointDevices    = "devices"
+	EndpointAttributes = "attributes"
+
+	defaultQueryMix    = "latest=4,timeseries=3,attributes=2,devices=1"
+	queryDevicesPage   = 100
+	queryTimeseriesLmt = 1000 //max points of a timeseries query
+)
+
+type QueryCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	store      StoreFlags
+	concurrent int
+	duration   int
+	requests   int
+	rps        float64
+	mix        string
+	keys       string
+	window     int
+	interval   int
+	agg        string
+}
+
+func newQueryCommand(m *Main) *QueryCommand {
+	return &QueryCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+//queryRequest is a request of an endpoint on device
+type queryRequest func(ctx context.Context, user *TenantUser, device *Device) error
+
+//weightedEndpoint is an endpoint picked weight times out of the total weight of the mix
+type weightedEndpoint struct {
+	name    string
+	weight  int
+	request queryRequest
+}
+
+//EndpointStats counts requests of an endpoint. It is safe for concurrent use.
+type EndpointStats struct {
+	requests int64
+	errors   int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+func (s *EndpointStats) observe(latency time.Duration, err error) {
+	atomic.AddInt64(&s.requests, 1)
+	if err != nil {
+		atomic.AddInt64(&s.errors, 1)
+		return
+	}
+	s.mu.Lock()
+	s.latencies = append(s.latencies, latency)
+	s.mu.Unlock()
+}
+
+//EndpointResult is the latency and error rate of an endpoint over a query run
+type EndpointResult struct {
+	Endpoint  string
+	Requests  int
+	Errors    int
+	ErrorRate float64
+	Latency   Latency
+}
+
+func (cmd *QueryCommand) Run(ctx context.Context, args ...string) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+
+	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
+	fs.IntVar(&cmd.concurrent, "concurrent", 10, "number of concurrent requests")
+	fs.IntVar(&cmd.duration, "duration", 30, "seconds to query. 0 means until -requests are sent or interrupted")
+	fs.IntVar(&cmd.requests, "requests", 0, "total number of requests. 0 means no limit")
+	fs.Float64Var(&cmd.rps, "rps", 0, "max requests per second. 0 means no limit")
+	fs.StringVar(&cmd.mix, "mix", defaultQueryMix, "weights of the endpoints latest, timeseries, attributes and devices")
+	fs.StringVar(&cmd.keys, "keys", ToolPrefix+"_key", "comma separated telemetry keys to query")
+	fs.IntVar(&cmd.window, "window", 3600, "seconds of timeseries ranges, ending now")
+	fs.IntVar(&cmd.interval, "interval", 60, "seconds of timeseries aggregation intervals")
+	fs.StringVar(&cmd.agg, "agg", "AVG", "timeseries aggregation, one of AVG, MIN, MAX, SUM, COUNT or NONE")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	} else if *help {
+		fs.Usage()
+		return nil
+	} else if cmd.concurrent < 1 || cmd.window < 1 || cmd.interval < 1 || (cmd.duration <= 0 && cmd.requests <= 0) {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	info, devices, err := loadDevices(cmd.store)
+	if err != nil {
+		return err
+	} else if len(devices) == 0 {
+		return fmt.Errorf("no devices in store, run init first")
+	}
+
+	mix, err := cmd.parseMix(info.namePrefix())
+	if err != nil {
+		return err
+	}
+
+	user, err := info.tenantUser(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	//devices provisioned over mqtt are stored without id
+	for _, device := range devices {
+		if device.Id, err = deviceId(ctx, user, device); err != nil {
+			return err
+		}
+	}
+
+	//cancel all requests on SIGINT or SIGTERM
+	ctx, cancel := notifyContext(ctx)
+	defer cancel()
+	if cmd.duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cmd.duration)*time.Second)
+		defer cancel()
+	}
+
+	summary := QuerySummary{Concurrent: cmd.concurrent, Rps: cmd.rps, Mix: cmd.mix}
+	summary.Endpoints = cmd.query(ctx, user, NewRateLimiter(cmd.rps), devices, mix)
+	printQuerySummary(summary)
+
+	//saved next to the summary of the last run, info -q prints it again
+	store, err := cmd.store.Open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = store.Close() }()
+	if err = store.SaveQuerySummary(summary); err != nil {
+		return err
+	}
+	return saveRefreshToken(store, user)
+}
+
+//parseMix parses name=weight pairs of -mix, devices are listed by namePrefix
+func (cmd *QueryCommand) parseMix(namePrefix string) ([]weightedEndpoint, error) {
+	requests := map[string]queryRequest{
+		EndpointLatest: func(ctx context.Context, user *TenantUser, device *Device) error {
+			_, err := user.GetLatestTelemetry(ctx, device.Id, cmd.keys)
+			return err
+		},
+		EndpointTimeseries: func(ctx context.Context, user *TenantUser, device *Device) error {
+			endTs := time.Now().UnixNano() / int64(time.Millisecond)
+			startTs := endTs - int64(cmd.window)*1000
+			_, err := user.GetAggregatedTimeseries(ctx, device.Id, cmd.keys, startTs, endTs, int64(cmd.interval)*1000, cmd.agg, queryTimeseriesLmt)
+			return err
+		},
+		EndpointAttributes: func(ctx context.Context, user *TenantUser, device *Device) error {
+			_, err := user.GetAttributes(ctx, device.Id)
+			return err
+		},
+		EndpointDevices: func(ctx context.Context, user *TenantUser, device *Device) error {
+			_, err := user.ListTenantDevices(ctx, namePrefix, queryDevicesPage, 0)
+			return err
+		},
+	}
+
+	var mix []weightedEndpoint
+	for _, pair := range strings.Split(cmd.mix, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		weight := 1
+		if len(parts) == 2 {
+			var err error
+			if weight, err = strconv.Atoi(parts[1]); err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in mix[%s]", pair)
+			}
+		}
+
+		name := parts[0]
+		request, ok := requests[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown endpoint[%s] in mix", name)
+		}
+
+		if weight > 0 {
+			mix = append(mix, weightedEndpoint{name: name, weight: weight, request: request})
+		}
+	}
+
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("mix[%s] has no endpoint", cmd.mix)
+	}
+	return mix, nil
+}
+
+//query sends requests of the mix to random devices with cmd.concurrent workers until ctx is done or
+//cmd.requests are sent. The workers wait on limiter before a request is timed, user has no limiter of its own.
+func (cmd *QueryCommand) query(ctx context.Context, user *TenantUser, limiter *RateLimiter, devices []*Device, mix []weightedEndpoint) []EndpointResult {
+	var total int
+	stats := make(map[string]*EndpointStats, len(mix))
+	for _, endpoint := range mix {
+		total += endpoint.weight
+		stats[endpoint.name] = &EndpointStats{}
+	}
+
+	var sent int64
+	var wg sync.WaitGroup
+	stopProgress := startQueryProgress(cmd.Stdout, progressInterval, stats)
+	for i := 0; i < cmd.concurrent; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for ctx.Err() == nil {
+				if cmd.requests > 0 && atomic.AddInt64(&sent, 1) > int64(cmd.requests) {
+					return
+				}
+
+				endpoint := pickEndpoint(mix, total, r)
+				device := devices[r.Intn(len(devices))]
+				//the wait for a turn under -rps is not latency of the endpoint
+				if err := limiter.Wait(ctx); err != nil {
+					return
+				}
+				start := time.Now()
+				err := endpoint.request(ctx, user, device)
+				if ctx.Err() != nil {
+					//a request cut short by the end of the run is not counted
+					return
+				}
+				stats[endpoint.name].observe(time.Since(start), err)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	stopProgress()
+
+	results := make([]EndpointResult, 0, len(stats))
+	for name, s := range stats {
+		result := EndpointResult{
+			Endpoint: name,
+			Requests: int(atomic.LoadInt64(&s.requests)),
+			Errors:   int(atomic.LoadInt64(&s.errors)),
+			Latency:  newLatency(s.latencies),
+		}
+		if result.Requests > 0 {
+			result.ErrorRate = float64(result.Errors) / float64(result.Requests)
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Endpoint < results[j].Endpoint
+	})
+	return results
+}
+
+func pickEndpoint(mix []weightedEndpoint, total int, r *rand.Rand) weightedEndpoint {
+	n := r.Intn(total)
+	for _, endpoint := range mix {
+		if n < endpoint.weight {
+			return endpoint
+		}
+		n -= endpoint.weight
+	}
+	return mix[len(mix)-1]
+}
+
+//startQueryProgress prints a progress line to w every interval until the returned stop is called
+func startQueryProgress(w io.Writer, interval time.Duration, stats map[string]*EndpointStats) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		start := time.Now()
+		last := start
+		var prev int64
+		for {
+			select {
+			case now := <-ticker.C:
+				var requests, errors int64
+				for _, s := range stats {
+					requests += atomic.LoadInt64(&s.requests)
+					errors += atomic.LoadInt64(&s.errors)
+				}
+				fmt.Fprintf(w, "[%5.0fs] requests: %d  rate: %.0f req/sec  errors: %d\n",
+					now.Sub(start).Seconds(), requests, float64(requests-prev)/now.Sub(last).Seconds(), errors)
+				prev = requests
+				last = now
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
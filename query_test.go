@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryCommand_Query(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == loginEnding:
+			_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+		case r.URL.Path == "/api/tenant/devices":
+			if r.URL.Query().Get("textSearch") != DeviceNamePrefix {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			_ = json.NewEncoder(w).Encode(TBDevicePage{Data: []TenantDeviceInfo{{Name: DeviceNamePrefix + "_0"}}, TotalPages: 1, TotalElements: 1})
+		case strings.HasSuffix(r.URL.Path, "/values/attributes"):
+			//attributes fail to check the error rate
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Query().Get("agg") != "":
+			if r.URL.Query().Get("agg") != "MAX" || r.URL.Query().Get("interval") != "60000" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			_ = json.NewEncoder(w).Encode(map[string][]TsValue{"key": {{Ts: 1, Value: "1.4"}}})
+		case strings.HasSuffix(r.URL.Path, "/values/timeseries"):
+			_ = json.NewEncoder(w).Encode(map[string][]TsValue{"key": {{Ts: 1, Value: "1.4"}}})
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+		}
+	}))
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := &QueryCommand{Stdout: &out, concurrent: 4, requests: 200, mix: "latest=1,timeseries=1,attributes=1,devices=1",
+		keys: "key", window: 3600, interval: 60, agg: "MAX"}
+	mix, err := cmd.parseMix(DeviceNamePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices := []*Device{{Id: "device-0", Name: DeviceNamePrefix + "_0"}, {Id: "device-1", Name: DeviceNamePrefix + "_1"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := cmd.query(ctx, user, nil, devices, mix)
+
+	if len(results) != 4 {
+		t.Fatalf("expected 4 endpoints, got %+v", results)
+	}
+
+	var total int
+	for _, r := range results {
+		total += r.Requests
+		if r.Requests == 0 {
+			t.Fatalf("endpoint %s got no requests", r.Endpoint)
+		}
+
+		if r.Endpoint == EndpointAttributes {
+			if r.Errors != r.Requests || r.ErrorRate != 1 || r.Latency.Samples != 0 {
+				t.Fatalf("expected all attributes requests to fail, got %+v", r)
+			}
+		} else if r.Errors != 0 || r.Latency.Samples != r.Requests {
+			t.Fatalf("unexpected result %+v", r)
+		}
+	}
+
+	if total != 200 {
+		t.Fatalf("expected 200 requests, got %d", total)
+	}
+}
+
+func TestQueryCommand_Saved(t *testing.T) {
+	initFakeServer(t, "-deviceNum", "2")
+
+	//the results of a query are saved like the summary of a run, and printed again by info
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	args := []string{"query", "-concurrent", "2", "-duration", "0", "-requests", "20", "-mix", "latest=1,devices=1"}
+	if err := main.Run(context.Background(), args...); err != nil {
+		t.Fatal(err)
+	}
+	if err := main.Run(context.Background(), "info", "-q"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenDeviceStore(DbFileName)
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := store.GetQuerySummary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int
+	for _, r := range summary.Endpoints {
+		requests += r.Requests - r.Errors
+	}
+	if summary.Concurrent != 2 || len(summary.Endpoints) != 2 || requests != 20 {
+		t.Fatalf("unexpected query summary %+v", summary)
+	}
+}
+
+func TestQueryCommand_ParseMix(t *testing.T) {
+	cmd := &QueryCommand{mix: "latest=2, devices=0,timeseries"}
+	mix, err := cmd.parseMix(DeviceNamePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mix) != 2 || mix[0].name != EndpointLatest || mix[0].weight != 2 || mix[1].name != EndpointTimeseries || mix[1].weight != 1 {
+		t.Fatalf("unexpected mix %+v", mix)
+	}
+
+	for _, invalid := range []string{"unknown=1", "latest=x", "latest=-1", "devices=0"} {
+		cmd.mix = invalid
+		if _, err = cmd.parseMix(DeviceNamePrefix); err == nil {
+			t.Fatalf("expected error for mix %s", invalid)
+		}
+	}
+}
+
+func TestQueryCommand_Limiter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == loginEnding {
+			_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]TsValue{"key": {{Ts: 1, Value: "1.4"}}})
+	}))
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	//4 workers share 10 requests per second, each waits about 400ms for its turn
+	cmd := &QueryCommand{Stdout: ioutil.Discard, concurrent: 4, requests: 8, mix: "latest", keys: "key"}
+	mix, err := cmd.parseMix(DeviceNamePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	results := cmd.query(context.Background(), user, NewRateLimiter(10), []*Device{{Id: "device-0"}}, mix)
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Fatalf("expected -rps to space out requests, took %s", elapsed)
+	}
+	if latency := results[0].Latency; latency.Samples != 8 || latency.Max > 100*time.Millisecond {
+		t.Fatalf("expected the wait for -rps left out of the latency, got %+v", latency)
+	}
+}
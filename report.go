@@ -4,6 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
+)
+
+const (
+	sparklineWidth = 60
+)
+
+var (
+	sparks = []rune("▁▂▃▄▅▆▇█")
 )
 
 const (
@@ -11,6 +20,7 @@ const (
 	PublishCompleteEvent = "PublishComplete"
 	PublishFailEvent     = "PublishFail"
 	TimeoutExceededEvent = "TimeoutExceeded"
+	InterruptedEvent     = "Interrupted"
 )
 
 type Summary struct {
@@ -23,13 +33,57 @@ type Summary struct {
 	ConnectFailed     int
 	PublishFailed     int
 	TimeoutExceeded   int
+	InterruptedClient int
+
+	// Interrupted is true when the run was stopped by a signal before it finished.
+	Interrupted bool
 
 	// ordered results
 	PublishPerformance []float64
 
 	PublishPerformanceMedian float64
 
-	PublishPerformanceHistogram map[float64]float64
+	// float64 keys cannot be marshaled, the histogram is rebuilt from PublishPerformance.
+	PublishPerformanceHistogram map[float64]float64 `json:"-"`
+
+	// per-second buckets recorded while running, left out with run -reportIntervals=false
+	Intervals []Interval
+
+	// from publish to PUBACK, and to arrival on a telemetry subscription
+	PubackLatency Latency
+	IngestLatency Latency
+}
+
+// QuerySummary is the summary of a query run, by endpoint
+type QuerySummary struct {
+	Concurrent int
+	Rps        float64
+	Mix        string
+	Endpoints  []EndpointResult
+}
+
+// Latency is the distribution of a latency over a run
+type Latency struct {
+	Samples int
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+}
+
+func newLatency(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+
+	sortLatencies(latencies)
+	return Latency{
+		Samples: len(latencies),
+		P50:     sortedPercentile(latencies, 50),
+		P90:     sortedPercentile(latencies, 90),
+		P99:     sortedPercentile(latencies, 99),
+		Max:     latencies[len(latencies)-1],
+	}
 }
 
 func buildSummary(nClient int, nMessages int, results []Result) (Summary, error) {
@@ -47,6 +101,7 @@ func buildSummary(nClient int, nMessages int, results []Result) (Summary, error)
 	nConnectFailed := 0
 	nPublishFailed := 0
 	nTimeoutExceeded := 0
+	nInterrupted := 0
 
 	publishPerformance := make([]float64, 0)
 
@@ -71,33 +126,40 @@ func buildSummary(nClient int, nMessages int, results []Result) (Summary, error)
 			nCompleted++
 		}
 
+		if r.Event == InterruptedEvent {
+			nInterrupted++
+		}
+
 		if r.Event == PublishCompleteEvent {
 			publishPerformance = append(publishPerformance, float64(r.MessagePublished)/r.PublishDoneTime.Seconds())
 		}
 	}
 
-	if len(publishPerformance) == 0 {
-		return Summary{}, errors.New("no feasible results found")
-	}
-
 	sort.Float64s(publishPerformance)
 
 	errorRate := float64(nErrors) / float64(nClient) * 100
 
-	return Summary{
-		Clients:                     nClient,
-		TotalMessages:               totalMessages,
-		MessagesPublished:           nMessagesPublished,
-		Errors:                      nErrors,
-		ErrorRate:                   errorRate,
-		Completed:                   nCompleted,
-		ConnectFailed:               nConnectFailed,
-		PublishFailed:               nPublishFailed,
-		TimeoutExceeded:             nTimeoutExceeded,
-		PublishPerformance:          publishPerformance,
-		PublishPerformanceMedian:    median(publishPerformance),
-		PublishPerformanceHistogram: buildHistogram(publishPerformance, nCompleted+nInProgress),
-	}, nil
+	summary := Summary{
+		Clients:            nClient,
+		TotalMessages:      totalMessages,
+		MessagesPublished:  nMessagesPublished,
+		Errors:             nErrors,
+		ErrorRate:          errorRate,
+		Completed:          nCompleted,
+		ConnectFailed:      nConnectFailed,
+		PublishFailed:      nPublishFailed,
+		TimeoutExceeded:    nTimeoutExceeded,
+		InterruptedClient:  nInterrupted,
+		PublishPerformance: publishPerformance,
+	}
+
+	//an interrupted or failed run may have no completed client
+	if len(publishPerformance) > 0 {
+		summary.PublishPerformanceMedian = median(publishPerformance)
+		summary.PublishPerformanceHistogram = buildHistogram(publishPerformance, nCompleted+nInProgress)
+	}
+
+	return summary, nil
 }
 
 func printSummary(summary Summary) {
@@ -108,7 +170,11 @@ func printSummary(summary Summary) {
 	fmt.Printf("Messages / Client:  %d\n", summary.TotalMessages)
 
 	fmt.Println()
-	fmt.Printf("# Results\n")
+	if summary.Interrupted {
+		fmt.Printf("# Results (interrupted)\n")
+	} else {
+		fmt.Printf("# Results\n")
+	}
 
 	fmt.Printf("Published Messages: %d (%.0f%%)\n", summary.MessagesPublished, (float64(summary.MessagesPublished) / float64(summary.TotalMessages) * 100))
 
@@ -121,6 +187,27 @@ func printSummary(summary Summary) {
 		fmt.Printf("- TimeoutExceeded:    %d (%.0f%%)\n", summary.TimeoutExceeded, (float64(summary.TimeoutExceeded) / float64(summary.Errors) * 100))
 	}
 
+	if summary.InterruptedClient > 0 {
+		fmt.Printf("Interrupted:        %d (%.0f%%)\n", summary.InterruptedClient, (float64(summary.InterruptedClient) / float64(summary.Clients) * 100))
+	}
+
+	if len(summary.Intervals) > 0 {
+		fmt.Println()
+		printSparklines(summary.Intervals)
+	}
+
+	if summary.PubackLatency.Samples > 0 || summary.IngestLatency.Samples > 0 {
+		fmt.Println()
+		fmt.Printf("# Latency\n")
+		fmt.Printf("%-8s %8s %10s %10s %10s %10s\n", "", "samples", "p50", "p90", "p99", "max")
+		printLatency("puback", summary.PubackLatency)
+		printLatency("ingest", summary.IngestLatency)
+	}
+
+	if len(summary.PublishPerformance) == 0 {
+		return
+	}
+
 	fmt.Println()
 	fmt.Printf("# Publishing Throughput\n")
 	fmt.Printf("Fastest: %.0f msg/sec\n", summary.PublishPerformance[len(summary.PublishPerformance)-1])
@@ -130,6 +217,120 @@ func printSummary(summary Summary) {
 	printHistogram(summary.PublishPerformanceHistogram)
 }
 
+func printLatency(name string, latency Latency) {
+	if latency.Samples == 0 {
+		return
+	}
+	fmt.Printf("%-8s %8d %10s %10s %10s %10s\n", name, latency.Samples,
+		latency.P50.Round(time.Microsecond), latency.P90.Round(time.Microsecond), latency.P99.Round(time.Microsecond), latency.Max.Round(time.Microsecond))
+}
+
+func printQuerySummary(summary QuerySummary) {
+	fmt.Println()
+	fmt.Printf("# Configuration\n")
+	fmt.Printf("Concurrent Requests: %d\n", summary.Concurrent)
+	if summary.Rps > 0 {
+		fmt.Printf("Requests / Second:   %.0f\n", summary.Rps)
+	}
+	fmt.Printf("Mix:                 %s\n", summary.Mix)
+
+	fmt.Println()
+	fmt.Printf("# Query Results\n")
+	fmt.Printf("%-12s %8s %8s %7s %10s %10s %10s %10s\n", "endpoint", "requests", "errors", "err%", "p50", "p90", "p99", "max")
+	for _, r := range summary.Endpoints {
+		fmt.Printf("%-12s %8d %8d %6.1f%% %10s %10s %10s %10s\n", r.Endpoint, r.Requests, r.Errors, r.ErrorRate*100,
+			r.Latency.P50.Round(time.Microsecond), r.Latency.P90.Round(time.Microsecond),
+			r.Latency.P99.Round(time.Microsecond), r.Latency.Max.Round(time.Microsecond))
+	}
+}
+
+func printSparklines(intervals []Interval) {
+	throughput := make([]float64, len(intervals))
+	latency := make([]float64, len(intervals))
+	connected := make([]float64, len(intervals))
+	var failed int
+	for i, iv := range intervals {
+		throughput[i] = iv.Throughput
+		latency[i] = float64(iv.LatencyP99) / float64(time.Millisecond)
+		connected[i] = float64(iv.Connected)
+		failed += iv.Failed
+	}
+
+	fmt.Printf("# Over Time (%d x 1s)\n", len(intervals))
+	fmt.Printf("msg/sec    %s  [%.0f - %.0f]\n", sparkline(throughput, sparklineWidth), minOf(throughput), maxOf(throughput))
+	fmt.Printf("p99 (ms)   %s  [%.1f - %.1f]\n", sparkline(latency, sparklineWidth), minOf(latency), maxOf(latency))
+	fmt.Printf("connected  %s  [%.0f - %.0f]\n", sparkline(connected, sparklineWidth), minOf(connected), maxOf(connected))
+	if failed > 0 {
+		fmt.Printf("failed     %d messages\n", failed)
+	}
+}
+
+func printIntervals(intervals []Interval) {
+	fmt.Printf("# Intervals\n")
+	fmt.Printf("%8s %10s %10s %10s %8s %10s %12s %12s %12s\n",
+		"Time", "Connected", "Published", "Acked", "Failed", "msg/sec", "p50", "p90", "p99")
+	for _, iv := range intervals {
+		fmt.Printf("%7.0fs %10d %10d %10d %8d %10.0f %12s %12s %12s\n",
+			iv.Elapsed.Seconds(), iv.Connected, iv.Published, iv.Acked, iv.Failed, iv.Throughput,
+			iv.LatencyP50, iv.LatencyP90, iv.LatencyP99)
+	}
+}
+
+//sparkline renders series with block characters, series longer than width is averaged down to width
+func sparkline(series []float64, width int) string {
+	if len(series) == 0 {
+		return ""
+	}
+
+	if len(series) > width {
+		step := (len(series) + width - 1) / width
+		var averaged []float64
+		for i := 0; i < len(series); i += step {
+			end := i + step
+			if end > len(series) {
+				end = len(series)
+			}
+			var sum float64
+			for _, v := range series[i:end] {
+				sum += v
+			}
+			averaged = append(averaged, sum/float64(end-i))
+		}
+		series = averaged
+	}
+
+	low, high := minOf(series), maxOf(series)
+	line := make([]rune, len(series))
+	for i, v := range series {
+		level := 0
+		if high > low {
+			level = int((v - low) / (high - low) * float64(len(sparks)-1))
+		}
+		line[i] = sparks[level]
+	}
+	return string(line)
+}
+
+func minOf(series []float64) float64 {
+	m := series[0]
+	for _, v := range series {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+func maxOf(series []float64) float64 {
+	m := series[0]
+	for _, v := range series {
+		if v > m {
+			m = v
+		}
+	}
+	return m
+}
+
 func buildHistogram(series []float64, total int) map[float64]float64 {
 	slowest := series[0]
 	fastest := series[len(series)-1]
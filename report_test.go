@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildSummary_Interrupted(t *testing.T) {
+	results := []Result{
+		{ClientId: "c0", Event: InterruptedEvent, MessagePublished: 3, PublishDoneTime: time.Second},
+		{ClientId: "c1", Event: InterruptedEvent, MessagePublished: 5, PublishDoneTime: time.Second},
+	}
+
+	summary, err := buildSummary(2, 10, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.InterruptedClient != 2 {
+		t.Fatalf("expected 2 interrupted clients, got %d", summary.InterruptedClient)
+	}
+
+	if summary.MessagesPublished != 8 {
+		t.Fatalf("expected 8 messages published, got %d", summary.MessagesPublished)
+	}
+
+	if summary.Errors != 0 {
+		t.Fatalf("expected no errors, got %d", summary.Errors)
+	}
+}
+
+func TestBuildSummary_NoResults(t *testing.T) {
+	if _, err := buildSummary(1, 10, nil); err == nil {
+		t.Fatal("expected error when no results collected")
+	}
+}
+
+func TestBuildSummary_Failed(t *testing.T) {
+	results := []Result{
+		{ClientId: "c0", Event: PublishFailEvent, Error: true, MessagePublished: 2},
+		{ClientId: "c1", Event: TimeoutExceededEvent, Error: true, MessagePublished: 4},
+	}
+
+	//a run where no client completed is still summarized
+	summary, err := buildSummary(2, 10, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Completed != 0 || summary.Errors != 2 || summary.PublishFailed != 1 || summary.TimeoutExceeded != 1 || summary.MessagesPublished != 6 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	if s := sparkline([]float64{0, 1, 2, 3, 4, 5, 6, 7}, 60); s != "▁▂▃▄▅▆▇█" {
+		t.Fatalf("unexpected sparkline %q", s)
+	}
+
+	if s := sparkline([]float64{3, 3, 3}, 60); s != "▁▁▁" {
+		t.Fatalf("unexpected sparkline for flat series %q", s)
+	}
+
+	series := make([]float64, 1800)
+	for i := range series {
+		series[i] = float64(i)
+	}
+	if n := len([]rune(sparkline(series, 60))); n != 60 {
+		t.Fatalf("expected sparkline of width 60, got %d", n)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//sessions opened in parallel
+	subscribeOpenWorkers = 20
+)
+
+type SubscribeCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	store    StoreFlags
+	sessions int
+	devices  int
+	keys     string
+	duration int
+}
+
+func newSubscribeCommand(m *Main) *SubscribeCommand {
+	return &SubscribeCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+//SubscribeStats counts updates received by websocket sessions. It is safe for concurrent use.
+type SubscribeStats struct {
+	opened  int64
+	failed  int64
+	dropped int64
+	updates int64
+	points  int64
+
+	mu       sync.Mutex
+	interval []time.Duration //lags of the current interval
+	lags     []time.Duration //lags of the run
+}
+
+func (s *SubscribeStats) update(points int, lags []time.Duration) {
+	atomic.AddInt64(&s.updates, 1)
+	atomic.AddInt64(&s.points, int64(points))
+	s.mu.Lock()
+	s.interval = append(s.interval, lags...)
+	s.lags = append(s.lags, lags...)
+	s.mu.Unlock()
+}
+
+func (s *SubscribeStats) takeInterval() []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lags := s.interval
+	s.interval = nil
+	return lags
+}
+
+func (cmd *SubscribeCommand) Run(ctx context.Context, args ...string) error {
+	fs := flag.NewFlagSet("subscribe", flag.ContinueOnError)
+
+	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
+	fs.IntVar(&cmd.sessions, "sessions", 10, "number of websocket sessions, like open dashboards")
+	fs.IntVar(&cmd.devices, "devices", 10, "number of stored devices every session subscribes to")
+	fs.StringVar(&cmd.keys, "keys", jsonSentKey, "comma separated telemetry keys to subscribe to")
+	fs.IntVar(&cmd.duration, "duration", 60, "seconds to keep the sessions open. 0 means until interrupted")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	} else if *help {
+		fs.Usage()
+		return nil
+	} else if cmd.sessions < 1 || cmd.devices < 1 || len(cmd.keys) == 0 {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	info, devices, err := loadDevices(cmd.store)
+	if err != nil {
+		return err
+	} else if len(devices) == 0 {
+		return fmt.Errorf("no devices in store, run init first")
+	}
+
+	user, err := info.tenantUser(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	//cancel all sessions on SIGINT or SIGTERM
+	ctx, cancel := notifyContext(ctx)
+	defer cancel()
+	if cmd.duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cmd.duration)*time.Second)
+		defer cancel()
+	}
+
+	if err = cmd.subscribe(ctx, user, devices); err != nil {
+		return err
+	}
+
+	//the store was closed while subscribed
+	store, err := cmd.store.Open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = store.Close() }()
+	return saveRefreshToken(store, user)
+}
+
+//loadDevices reads init info and the stored devices, the store is closed again so run and the others can open it
+func loadDevices(s StoreFlags) (InitCommandInfo, []*Device, error) {
+	var info InitCommandInfo
+	store, err := s.Open()
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		return info, nil, err
+	}
+
+	if err = info.Restore(store); err != nil {
+		return info, nil, err
+	}
+
+	devices, err := store.ListDevices(info.namePrefix())
+	return info, devices, err
+}
+
+//subscribe opens cmd.sessions sessions over devices round robin and counts updates until ctx is done
+func (cmd *SubscribeCommand) subscribe(ctx context.Context, user *TenantUser, devices []*Device) error {
+	keys := strings.Split(cmd.keys, ",")
+	stats := &SubscribeStats{}
+
+	indexes := make([]int, cmd.sessions)
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	//only the subscribed devices are needed
+	needed := cmd.sessions * cmd.devices
+	if needed > len(devices) {
+		needed = len(devices)
+	}
+	ids := make([]string, needed)
+	for i := range ids {
+		id, err := deviceId(ctx, user, devices[i])
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+
+	//latest values sent before the sessions opened are left by earlier runs
+	sinceMs := time.Now().UnixNano() / int64(time.Millisecond)
+	var mu sync.Mutex
+	var sessions []*TelemetrySession
+	fmt.Fprintf(cmd.Stdout, "opening %d sessions on %d devices\n", cmd.sessions, len(ids))
+	//sessions outlive the workers opening them, so they are bound to ctx of the command
+	sessionCtx := ctx
+	err := runWorkers(ctx, cmd.Stdout, indexes, subscribeOpenWorkers, func(ctx context.Context, bar *ProgressBar, index int) error {
+		deviceIds := make([]string, 0, cmd.devices)
+		for j := 0; j < cmd.devices; j++ {
+			deviceIds = append(deviceIds, ids[(index*cmd.devices+j)%len(ids)])
+		}
+
+		session, err := OpenTelemetrySession(sessionCtx, user, deviceIds, keys, func(update *SubscriptionUpdate) {
+			now := time.Now().UnixNano() / int64(time.Millisecond)
+			var points int
+			var lags []time.Duration
+			for key, values := range update.Data {
+				for _, point := range values {
+					ts, value, ok := pointValue(point)
+					if !ok {
+						continue
+					}
+
+					//lag is measured from the send time carried by tbload messages, else from the telemetry ts
+					sent := ts
+					if key == jsonSentKey || key == protobufSentKey {
+						sent = int64(value)
+					}
+					if sent < sinceMs {
+						continue
+					}
+					points++
+					lags = append(lags, time.Duration(now-sent)*time.Millisecond)
+				}
+			}
+			stats.update(points, lags)
+		})
+		if err != nil {
+			atomic.AddInt64(&stats.failed, 1)
+			bar.Printf("session[%d] %v\n", index, err)
+			return nil
+		}
+
+		atomic.AddInt64(&stats.opened, 1)
+		mu.Lock()
+		sessions = append(sessions, session)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	start := time.Now()
+	stopProgress := stats.startProgress(cmd.Stdout, progressInterval, cmd.sessions)
+	<-ctx.Done()
+	stopProgress()
+
+	//sessions closed by the server before the end are dropped
+	for _, session := range sessions {
+		if session.Dropped() {
+			atomic.AddInt64(&stats.dropped, 1)
+		}
+		session.Close()
+	}
+
+	stats.print(cmd.Stdout, time.Since(start))
+	return nil
+}
+
+//deviceId returns the id of device, devices provisioned over mqtt are stored without id. A device missing on
+//thingsboard is a not found error, see IsNotFound.
+func deviceId(ctx context.Context, user *TenantUser, device *Device) (string, error) {
+	if len(device.Id) > 0 {
+		return device.Id, nil
+	}
+
+	found, err := user.GetDevice(ctx, device.Name)
+	if err != nil {
+		return "", err
+	} else if len(found.Id) == 0 {
+		message := fmt.Sprintf("device[%s] not exist on thingsboard", device.Name)
+		return "", &APIError{StatusCode: http.StatusNotFound, ErrorCode: ErrorCodeItemNotFound, Message: message}
+	}
+	return found.Id, nil
+}
+
+//startProgress prints a progress line to w every interval until the returned stop is called
+func (s *SubscribeStats) startProgress(w io.Writer, interval time.Duration, sessions int) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		start := time.Now()
+		last := start
+		var prev int64
+		for {
+			select {
+			case now := <-ticker.C:
+				updates := atomic.LoadInt64(&s.updates)
+				fmt.Fprintf(w, "[%5.0fs] sessions: %d/%d  updates: %d  rate: %.0f updates/sec  lag p99: %s\n",
+					now.Sub(start).Seconds(), atomic.LoadInt64(&s.opened), sessions, updates,
+					float64(updates-prev)/now.Sub(last).Seconds(), percentile(s.takeInterval(), 99))
+				prev = updates
+				last = now
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+func (s *SubscribeStats) print(w io.Writer, elapsed time.Duration) {
+	updates := atomic.LoadInt64(&s.updates)
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "# Subscriptions\n")
+	fmt.Fprintf(w, "Sessions:           %d\n", atomic.LoadInt64(&s.opened))
+	fmt.Fprintf(w, "Failed:             %d\n", atomic.LoadInt64(&s.failed))
+	fmt.Fprintf(w, "Dropped:            %d\n", atomic.LoadInt64(&s.dropped))
+	fmt.Fprintf(w, "Updates:            %d (%.0f/sec)\n", updates, float64(updates)/elapsed.Seconds())
+	fmt.Fprintf(w, "Points:             %d\n", atomic.LoadInt64(&s.points))
+
+	s.mu.Lock()
+	lag := newLatency(s.lags)
+	s.mu.Unlock()
+	if lag.Samples == 0 {
+		return
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "# Lag\n")
+	fmt.Fprintf(w, "%8s %10s %10s %10s %10s\n", "samples", "p50", "p90", "p99", "max")
+	fmt.Fprintf(w, "%8d %10s %10s %10s %10s\n", lag.Samples, lag.P50, lag.P90, lag.P99, lag.Max)
+}
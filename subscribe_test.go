@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestSubscribeCommand_Subscribe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(loginEnding, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+	})
+	mux.Handle("/api/ws/plugins/telemetry", websocket.Handler(func(conn *websocket.Conn) {
+		var cmds TelemetryPluginCmds
+		if err := websocket.JSON.Receive(conn, &cmds); err != nil {
+			return
+		}
+
+		//every subscribed device gets one update sent now
+		for _, sub := range cmds.TsSubCmds {
+			now := time.Now().UnixNano() / int64(time.Millisecond)
+			_ = websocket.JSON.Send(conn, SubscriptionUpdate{
+				SubscriptionId: sub.CmdId,
+				Data:           map[string][][]interface{}{jsonSentKey: {{now, strconv.FormatInt(now, 10)}}},
+			})
+		}
+
+		var ignored interface{}
+		_ = websocket.JSON.Receive(conn, &ignored)
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := &SubscribeCommand{Stdout: &out, sessions: 3, devices: 2, keys: jsonSentKey}
+	devices := []*Device{{Id: "device-1"}, {Id: "device-2"}, {Id: "device-3"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := cmd.subscribe(ctx, user, devices); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"Sessions:           3", "Dropped:            0", "Updates:            6", "Points:             6"} {
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("expected %q in\n%s", line, out.String())
+		}
+	}
+}
@@ -2,34 +2,65 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	applicationJson    = "application/json"
 	loginEnding        = "/api/auth/login"
+	refreshTokenEnding = "/api/auth/token"
 	saveDeviceEnding   = "/api/device"
 	deleteDeviceEnding = "/api/device/"
 	getDeviceIdEnding  = "/api/tenant/devices?deviceName=%s"
 	getDeviceAuthToken = "/api/device/%s/credentials"
+
+	getTimeseriesEnding     = "/api/plugins/telemetry/DEVICE/%s/values/timeseries?keys=%s&startTs=%d&endTs=%d&limit=%d&agg=NONE&orderBy=ASC"
+	getLatestTelemetry      = "/api/plugins/telemetry/DEVICE/%s/values/timeseries?keys=%s"
+	getAggTimeseries        = "/api/plugins/telemetry/DEVICE/%s/values/timeseries?keys=%s&startTs=%d&endTs=%d&interval=%d&agg=%s&limit=%d"
+	getAttributes           = "/api/plugins/telemetry/DEVICE/%s/values/attributes"
+	getTenantDevices        = "/api/tenant/devices?pageSize=%d&page=%d&textSearch=%s"
+	getDeviceProfileInfos   = "/api/deviceProfileInfos?pageSize=100&page=%d&textSearch=%s"
+	entityTypeDeviceProfile = "DEVICE_PROFILE"
+
+	//refresh the jwt this long before it expires
+	tokenRefreshMargin = time.Minute
 )
 
 //tenant user
 type TenantUser struct {
-	ServerHost string `json:"-"`
-	Username   string `json:"username"`
-	Password   string `json:"password"`
-	Jwt        string `json:"-"`
+	ServerHost   string    `json:"-"`
+	Username     string    `json:"username"`
+	Password     string    `json:"password"`
+	Jwt          string    `json:"-"`
+	RefreshToken string    `json:"-"`
+	ExpiresAt    time.Time `json:"-"`
+
+	//Limiter throttles requests sent with the jwt, nil means no limit
+	Limiter *RateLimiter `json:"-"`
+
+	mu sync.Mutex //guards Jwt, RefreshToken and ExpiresAt
 }
 
 //Token is token
 type Token struct {
-	Token string
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+//RefreshTokenRequest is the body of /api/auth/token
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
 }
 
 //device info
@@ -41,6 +72,9 @@ type Device struct {
 	Label        string
 	AuthToken    string
 	SeqNo        int
+
+	DeviceProfileId string
+	External        bool `json:",omitempty"` //imported, tbload never deletes it on thingsboard
 }
 
 //NewDevice returns a default Device Pointer
@@ -66,14 +100,15 @@ func extractSeqNo(name string) (int, error) {
 
 //TBDevice correspond to response data struct from tb rest api
 type TBDevice struct {
-	AdditionalInfo string   `json:"additionalInfo"`
-	CreatedTime    int64    `json:"createdTime"`
-	CustomerId     EntityId `json:"customerId"`
-	Id             EntityId `json:"id"`
-	Label          string   `json:"label"`
-	Name           string   `json:"name"`
-	TenantId       EntityId `json:"tenantId"`
-	Type           string   `json:"type"`
+	AdditionalInfo  string   `json:"additionalInfo"`
+	CreatedTime     int64    `json:"createdTime"`
+	CustomerId      EntityId `json:"customerId"`
+	Id              EntityId `json:"id"`
+	Label           string   `json:"label"`
+	Name            string   `json:"name"`
+	TenantId        EntityId `json:"tenantId"`
+	Type            string   `json:"type"`
+	DeviceProfileId EntityId `json:"deviceProfileId"`
 }
 
 type EntityId struct {
@@ -90,24 +125,108 @@ type Credential struct {
 	CredentialsValue string   `json:"CredentialsValue"`
 }
 
+//ThingsBoard error codes of APIError.ErrorCode
+const (
+	ErrorCodeGeneral          = 2
+	ErrorCodeAuthentication   = 10
+	ErrorCodeJwtTokenExpired  = 11
+	ErrorCodePermissionDenied = 20
+	ErrorCodeBadRequestParams = 31
+	ErrorCodeItemNotFound     = 32
+	ErrorCodeTooManyRequests  = 33
+)
+
+//APIError is an error response of tb rest api
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Status     int    `json:"status"`
+	Message    string `json:"message"`
+	ErrorCode  int    `json:"errorCode"`
+}
+
+//newAPIError parses body as a thingsboard error, a body which is not is kept as message
+func newAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil || len(apiErr.Message) == 0 {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	apiErr.StatusCode = statusCode
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("thingsboard api error|status=%d|errorCode=%d|msg=%s", e.StatusCode, e.ErrorCode, e.Message)
+}
+
+//IsNotFound reports whether err is an APIError for a missing item
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && (apiErr.StatusCode == http.StatusNotFound || apiErr.ErrorCode == ErrorCodeItemNotFound)
+}
+
 func NewTenantUser(serverHost, username, password string) (*TenantUser, error) {
 	return &TenantUser{ServerHost: serverHost, Username: username, Password: password}, nil
 }
 
 //Login get token
-func (u *TenantUser) Login() error {
-	url := u.ServerHost + loginEnding
+func (u *TenantUser) Login(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.login(ctx)
+}
+
+//LoginWithRefreshToken gets a token with the refresh token of an earlier login instead of the password
+func (u *TenantUser) LoginWithRefreshToken(ctx context.Context, refreshToken string) error {
+	data, err := json.Marshal(RefreshTokenRequest{refreshToken})
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requestToken(ctx, u.ServerHost+refreshTokenEnding, data)
+}
+
+//login gets a new token with username and password, u.mu must be held
+func (u *TenantUser) login(ctx context.Context) error {
 	data, err := json.Marshal(u)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(url, applicationJson, bytes.NewReader([]byte(data)))
+
+	return u.requestToken(ctx, u.ServerHost+loginEnding, data)
+}
+
+//refresh exchanges the refresh token for a new token. A user with a password falls back to login, one logged in
+//with a refresh token has nothing else to try. u.mu must be held
+func (u *TenantUser) refresh(ctx context.Context) error {
+	if len(u.RefreshToken) == 0 {
+		if len(u.Password) == 0 {
+			return fmt.Errorf("no password or refresh token of %s", u.Username)
+		}
+		return u.login(ctx)
+	}
+
+	data, err := json.Marshal(RefreshTokenRequest{u.RefreshToken})
+	if err != nil {
+		return err
+	}
+
+	if err = u.requestToken(ctx, u.ServerHost+refreshTokenEnding, data); err != nil && len(u.Password) > 0 {
+		return u.login(ctx)
+	}
+	return err
+}
+
+//requestToken posts data to a token endpoint and keeps the returned tokens, u.mu must be held
+func (u *TenantUser) requestToken(ctx context.Context, url string, data []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
-	defer func() { _ = resp.Body.Close() }()
+	request.Header = map[string][]string{"Content-Type": {applicationJson}}
 
-	all, err := ioutil.ReadAll(resp.Body)
+	all, err := send(request)
 	if err != nil {
 		return err
 	}
@@ -117,38 +236,151 @@ func (u *TenantUser) Login() error {
 		return err
 	}
 
+	if len(token.Token) == 0 {
+		return fmt.Errorf("login fail|msg=%s", string(all))
+	}
+
 	u.Jwt = fmt.Sprintf("Bearer %s", token.Token)
+	u.RefreshToken = token.RefreshToken
+	u.ExpiresAt = jwtExpiration(token.Token)
 
 	return nil
 }
 
-type SaveDeviceRequest struct {
-	DeviceName string `json:"name"`
-	DeviceType string `json:"type"`
+//authorization returns the X-Authorization header, the token is refreshed shortly before it expires
+func (u *TenantUser) authorization(ctx context.Context) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.ExpiresAt.IsZero() && time.Until(u.ExpiresAt) < tokenRefreshMargin {
+		if err := u.refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+	return u.Jwt, nil
 }
 
-//CreateDevice creates device on thingsboard
-func (u *TenantUser) CreateDevice(device *Device) error {
-	url := u.ServerHost + saveDeviceEnding
+//relogin logs in again unless another request already replaced the rejected jwt, a user without password
+//uses its refresh token
+func (u *TenantUser) relogin(ctx context.Context, rejected string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
-	saveDeviceRequest := SaveDeviceRequest{device.Name, device.Type}
-	data, err := json.Marshal(saveDeviceRequest)
-	if err != nil {
-		return err
+	if u.Jwt != rejected {
+		return nil
+	} else if len(u.Password) == 0 {
+		return u.refresh(ctx)
 	}
-	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
-	if err != nil {
-		return err
+	return u.login(ctx)
+}
+
+//do sends an authorized request and returns the response body or an *APIError.
+//A request rejected with 401 is retried once after a new login.
+func (u *TenantUser) do(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	for retry := true; ; retry = false {
+		if err := u.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		jwt, err := u.authorization(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		request, err := http.NewRequestWithContext(ctx, method, url, reader)
+		if err != nil {
+			return nil, err
+		}
+		request.Header = map[string][]string{"Content-Type": {applicationJson}, "X-Authorization": {jwt}}
+
+		all, err := send(request)
+		if apiErr, ok := err.(*APIError); ok && apiErr.StatusCode == http.StatusUnauthorized && retry {
+			if err = u.relogin(ctx, jwt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return all, err
 	}
-	request.Header = map[string][]string{"Content-Type": {applicationJson}, "X-Authorization": {u.Jwt}}
+}
 
+//send sends request and returns the response body, a non 2xx response is returned as *APIError
+func send(request *http.Request) ([]byte, error) {
 	response, err := http.DefaultClient.Do(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() { _ = response.Body.Close() }()
 
 	all, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, newAPIError(response.StatusCode, all)
+	}
+	return all, nil
+}
+
+//jwtExpiration reads the exp claim of a jwt, a zero time is returned if it cannot be read
+func jwtExpiration(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+type SaveDeviceRequest struct {
+	DeviceName      string    `json:"name"`
+	DeviceType      string    `json:"type"`
+	Label           string    `json:"label,omitempty"`
+	DeviceProfileId *EntityId `json:"deviceProfileId,omitempty"`
+}
+
+//DeviceProfileInfo correspond to an item of /api/deviceProfileInfos
+type DeviceProfileInfo struct {
+	Id   EntityId `json:"id"`
+	Name string   `json:"name"`
+	Type string   `json:"type"`
+}
+
+//DeviceProfileInfoPage correspond to response data struct of /api/deviceProfileInfos
+type DeviceProfileInfoPage struct {
+	Data    []DeviceProfileInfo `json:"data"`
+	HasNext bool                `json:"hasNext"`
+}
+
+//CreateDevice creates device on thingsboard
+func (u *TenantUser) CreateDevice(ctx context.Context, device *Device) error {
+	url := u.ServerHost + saveDeviceEnding
+
+	saveDeviceRequest := SaveDeviceRequest{DeviceName: device.Name, DeviceType: device.Type, Label: device.Label}
+	if len(device.DeviceProfileId) > 0 {
+		saveDeviceRequest.DeviceProfileId = &EntityId{Id: device.DeviceProfileId, EntityType: entityTypeDeviceProfile}
+	}
+	data, err := json.Marshal(saveDeviceRequest)
+	if err != nil {
+		return err
+	}
+	all, err := u.do(ctx, http.MethodPost, url, data)
 	if err != nil {
 		return err
 	}
@@ -167,46 +399,30 @@ func (u *TenantUser) CreateDevice(device *Device) error {
 	device.Id = tbDevice.Id.Id
 	device.AdditionInfo = tbDevice.AdditionalInfo
 	device.Label = tbDevice.Label
+	device.DeviceProfileId = tbDevice.DeviceProfileId.Id
 
 	return nil
 }
 
 //DeleteDevice deletes device on thingsboard
-func (u *TenantUser) DeleteDevice(deviceId string) error {
+func (u *TenantUser) DeleteDevice(ctx context.Context, deviceId string) error {
 	url := u.ServerHost + deleteDeviceEnding + deviceId
 
-	request, err := http.NewRequest(http.MethodDelete, url, nil)
-	if err != nil {
-		return err
-	}
-
-	request.Header = map[string][]string{"X-Authorization": {u.Jwt}}
-
-	if _, err := http.DefaultClient.Do(request); err != nil {
+	if _, err := u.do(ctx, http.MethodDelete, url, nil); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-//GetDevice gets device from thingsboard
-func (u *TenantUser) GetDevice(deviceName string) (*Device, error) {
-	url := u.ServerHost + fmt.Sprintf(getDeviceIdEnding, deviceName)
-
-	request, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return &Device{}, err
-	}
-	request.Header = map[string][]string{"X-Authorization": {u.Jwt}}
+//GetDevice gets device from thingsboard, the returned device has no Id if it does not exist
+func (u *TenantUser) GetDevice(ctx context.Context, deviceName string) (*Device, error) {
+	url := u.ServerHost + fmt.Sprintf(getDeviceIdEnding, neturl.QueryEscape(deviceName))
 
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return &Device{}, err
-	}
-	defer func() { _ = response.Body.Close() }()
-
-	all, err := ioutil.ReadAll(response.Body)
-	if err != nil {
+	all, err := u.do(ctx, http.MethodGet, url, nil)
+	if IsNotFound(err) {
+		return &Device{}, nil
+	} else if err != nil {
 		return &Device{}, err
 	}
 	//log.Printf("%s\n", string(all))
@@ -218,30 +434,47 @@ func (u *TenantUser) GetDevice(deviceName string) (*Device, error) {
 	//log.Printf("%+v\n", tbDevice)
 
 	return &Device{
-		Id:           tbDevice.Id.Id,
-		Name:         deviceName,
-		Type:         tbDevice.Type,
-		AdditionInfo: tbDevice.AdditionalInfo,
-		Label:        tbDevice.Label}, nil
+		Id:              tbDevice.Id.Id,
+		Name:            deviceName,
+		Type:            tbDevice.Type,
+		AdditionInfo:    tbDevice.AdditionalInfo,
+		Label:           tbDevice.Label,
+		DeviceProfileId: tbDevice.DeviceProfileId.Id}, nil
 }
 
-//GetDeviceAuthToken gets authToken of device on thingsboard
-func (u *TenantUser) GetDeviceAuthToken(deviceId string) (string, error) {
-	url := u.ServerHost + fmt.Sprintf(getDeviceAuthToken, deviceId)
-
-	request, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return "", err
+//GetDeviceProfileId gets the id of the device profile named profileName, ErrDeviceProfileNotExist if there is none
+func (u *TenantUser) GetDeviceProfileId(ctx context.Context, profileName string) (string, error) {
+	for page := 0; ; page++ {
+		url := u.ServerHost + fmt.Sprintf(getDeviceProfileInfos, page, neturl.QueryEscape(profileName))
+
+		all, err := u.do(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+
+		var infos DeviceProfileInfoPage
+		if err = json.Unmarshal(all, &infos); err != nil {
+			return "", err
+		}
+
+		//textSearch matches prefixes, so look for the exact name
+		for _, info := range infos.Data {
+			if info.Name == profileName {
+				return info.Id.Id, nil
+			}
+		}
+
+		if !infos.HasNext {
+			return "", ErrDeviceProfileNotExist
+		}
 	}
-	request.Header = map[string][]string{"X-Authorization": {u.Jwt}}
+}
 
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = response.Body.Close() }()
+//GetDeviceAuthToken gets authToken of device on thingsboard
+func (u *TenantUser) GetDeviceAuthToken(ctx context.Context, deviceId string) (string, error) {
+	url := u.ServerHost + fmt.Sprintf(getDeviceAuthToken, deviceId)
 
-	all, err := ioutil.ReadAll(response.Body)
+	all, err := u.do(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return "", err
 	}
@@ -259,3 +492,104 @@ func (u *TenantUser) GetDeviceAuthToken(deviceId string) (string, error) {
 	//log.Printf("%+v\n", credential)
 	return credential.CredentialsId, nil
 }
+
+//TsValue correspond to a point of /api/plugins/telemetry/DEVICE/{id}/values/timeseries
+type TsValue struct {
+	Ts    int64       `json:"ts"`
+	Value interface{} `json:"value"`
+}
+
+//GetTimeseries gets at most limit points of key between startTs and endTs in milliseconds, oldest first
+func (u *TenantUser) GetTimeseries(ctx context.Context, deviceId, key string, startTs, endTs int64, limit int) ([]TsValue, error) {
+	url := u.ServerHost + fmt.Sprintf(getTimeseriesEnding, deviceId, neturl.QueryEscape(key), startTs, endTs, limit)
+
+	all, err := u.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var series map[string][]TsValue
+	if err = json.Unmarshal(all, &series); err != nil {
+		return nil, err
+	}
+	return series[key], nil
+}
+
+//GetLatestTelemetry gets the latest value of keys
+func (u *TenantUser) GetLatestTelemetry(ctx context.Context, deviceId string, keys string) (map[string][]TsValue, error) {
+	url := u.ServerHost + fmt.Sprintf(getLatestTelemetry, deviceId, neturl.QueryEscape(keys))
+
+	all, err := u.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var series map[string][]TsValue
+	err = json.Unmarshal(all, &series)
+	return series, err
+}
+
+//GetAggregatedTimeseries gets keys between startTs and endTs aggregated by agg (e.g., AVG) over interval milliseconds
+func (u *TenantUser) GetAggregatedTimeseries(ctx context.Context, deviceId, keys string, startTs, endTs, interval int64, agg string, limit int) (map[string][]TsValue, error) {
+	url := u.ServerHost + fmt.Sprintf(getAggTimeseries, deviceId, neturl.QueryEscape(keys), startTs, endTs, interval, agg, limit)
+
+	all, err := u.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var series map[string][]TsValue
+	err = json.Unmarshal(all, &series)
+	return series, err
+}
+
+//AttributeValue correspond to an item of /api/plugins/telemetry/DEVICE/{id}/values/attributes
+type AttributeValue struct {
+	LastUpdateTs int64       `json:"lastUpdateTs"`
+	Key          string      `json:"key"`
+	Value        interface{} `json:"value"`
+}
+
+//GetAttributes gets all attributes of the device
+func (u *TenantUser) GetAttributes(ctx context.Context, deviceId string) ([]AttributeValue, error) {
+	url := u.ServerHost + fmt.Sprintf(getAttributes, deviceId)
+
+	all, err := u.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes []AttributeValue
+	err = json.Unmarshal(all, &attributes)
+	return attributes, err
+}
+
+//TenantDeviceInfo correspond to an item of /api/tenant/devices, additionalInfo is left out as its shape
+//differs between thingsboard versions
+type TenantDeviceInfo struct {
+	Id   EntityId `json:"id"`
+	Name string   `json:"name"`
+	Type string   `json:"type"`
+}
+
+//TBDevicePage correspond to response data struct of /api/tenant/devices
+type TBDevicePage struct {
+	Data          []TenantDeviceInfo `json:"data"`
+	TotalPages    int                `json:"totalPages"`
+	TotalElements int                `json:"totalElements"`
+	HasNext       bool               `json:"hasNext"`
+}
+
+//ListTenantDevices gets a page of the tenant devices whose names start with textSearch
+func (u *TenantUser) ListTenantDevices(ctx context.Context, textSearch string, pageSize, page int) (*TBDevicePage, error) {
+	url := u.ServerHost + fmt.Sprintf(getTenantDevices, pageSize, page, neturl.QueryEscape(textSearch))
+
+	all, err := u.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices TBDevicePage
+	err = json.Unmarshal(all, &devices)
+	return &devices, err
+}
@@ -1,116 +1,371 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+//loginFakeServer starts a FakeServer and returns a tenant user logged in to it
+func loginFakeServer(t *testing.T) (*FakeServer, *TenantUser) {
+	server := NewFakeServer(FakeUsername, FakePassword)
+	user, _ := NewTenantUser(server.URL, FakeUsername, FakePassword)
+	if err := user.Login(context.Background()); err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, user
+}
+
 func TestTenantUser_Login(t *testing.T) {
-	//s := "http://localhost:4200"
-	//u := "tenant@thingsboard.org"
-	//p := "tenant"
-
-	//s := "http://localhost:3000"
-	//u := "fuhaiyinga@enn.cn"
-	//p := "123456"
-
-	s := "http://139.219.2.82:8080"
-	u := "alenym@163.com"
-	p := "123456"
-	user, err := NewTenantUser(s, u, p)
+	server, user := loginFakeServer(t)
+	defer server.Close()
+
+	if !strings.HasPrefix(user.Jwt, "Bearer ") || len(user.RefreshToken) == 0 || time.Until(user.ExpiresAt) < time.Hour {
+		t.Fatalf("unexpected tokens %s %s %s", user.Jwt, user.RefreshToken, user.ExpiresAt)
+	}
+
+	device, err := NewDevice("device-abc_1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = user.Login()
-	if err != nil {
+
+	if err = user.CreateDevice(context.Background(), device); err != nil {
 		t.Fatal(err)
 	}
 
-	log.Printf("%+v", *user)
-	bytes, _ := json.Marshal(user)
-	log.Println(string(bytes))
+	if len(device.Id) == 0 || len(device.DeviceProfileId) == 0 {
+		t.Fatalf("expected device with id and profile, got %+v", device)
+	}
 
-	device, err := NewDevice("device-abc1")
-	if err != nil {
+	//names are unique
+	if err = user.CreateDevice(context.Background(), device); err == nil {
+		t.Fatal("expected error for a duplicate name")
+	}
+
+	wrong, _ := NewTenantUser(server.URL, FakeUsername, "wrong")
+	if err = wrong.Login(context.Background()); err == nil {
+		t.Fatal("expected error for a wrong password")
+	}
+}
+
+func TestTenantUser_DeleteDevice(t *testing.T) {
+	server, user := loginFakeServer(t)
+	defer server.Close()
+
+	device := &Device{Name: "device_0", Type: "default"}
+	if err := user.CreateDevice(context.Background(), device); err != nil {
 		t.Fatal(err)
 	}
 
-	err = user.CreateDevice(device)
-	if err != nil {
+	if err := user.DeleteDevice(context.Background(), device.Id); err != nil {
 		t.Fatal(err)
 	}
 
-	fmt.Printf("%+v\n", device)
+	if _, ok := server.device(device.Name); ok {
+		t.Fatalf("device[%s] not deleted", device.Name)
+	}
 
+	if err := user.DeleteDevice(context.Background(), device.Id); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
 }
 
-func TestTenantUser_DeleteDevice(t *testing.T) {
-	s := "http://139.219.2.82:8080"
-	u := "alenym@163.com"
-	p := "123456"
-	user, err := NewTenantUser(s, u, p)
-	if err != nil {
+func TestTenantUser_GetDevice(t *testing.T) {
+	server, user := loginFakeServer(t)
+	defer server.Close()
+
+	created := &Device{Name: "camera-1", Type: "camera", Label: "front door"}
+	if err := user.CreateDevice(context.Background(), created); err != nil {
 		t.Fatal(err)
 	}
-	err = user.Login()
+
+	device, err := user.GetDevice(context.Background(), created.Name)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = user.DeleteDevice("a0ab59a0-258e-11eb-8359-3b3967916152")
+	if device.Id != created.Id || device.Type != "camera" || device.Label != "front door" {
+		t.Fatalf("expected %+v, got %+v", created, device)
+	}
+
+	if device, err = user.GetDevice(context.Background(), "missing"); err != nil || len(device.Id) > 0 {
+		t.Fatalf("expected device without id, got %+v, %v", device, err)
+	}
+}
+
+func TestTenantUser_GetDeviceAuthToken(t *testing.T) {
+	server, user := loginFakeServer(t)
+	defer server.Close()
+
+	device := &Device{Name: "device_0", Type: "default"}
+	if err := user.CreateDevice(context.Background(), device); err != nil {
+		t.Fatal(err)
+	}
+
+	authToken, err := user.GetDeviceAuthToken(context.Background(), device.Id)
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	expected, _ := server.device(device.Name)
+	if authToken != expected.token {
+		t.Fatalf("expected %s, got %s", expected.token, authToken)
+	}
+
+	if name, err := server.Authenticate(authToken); err != nil || name != device.Name {
+		t.Fatalf("expected %s, got %s %v", device.Name, name, err)
+	}
 }
 
-func TestTenantUser_GetDevice(t *testing.T) {
-	s := "http://139.219.2.82:8080"
-	u := "alenym@163.com"
-	p := "123456"
-	user, err := NewTenantUser(s, u, p)
-	if err != nil {
+//testJwt returns an unsigned jwt which expires at exp
+func testJwt(exp time.Time) string {
+	claims, _ := json.Marshal(map[string]int64{"exp": exp.Unix()})
+	return "eyJhbGciOiJIUzUxMiJ9." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln"
+}
+
+func TestTenantUser_RetryOnUnauthorized(t *testing.T) {
+	var logins int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case loginEnding:
+			n := atomic.AddInt32(&logins, 1)
+			_ = json.NewEncoder(w).Encode(Token{Token: fmt.Sprintf("token-%d", n)})
+		case "/api/tenant/devices":
+			//the first token is rejected as if it had expired
+			if r.Header.Get("X-Authorization") != "Bearer token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(TBDevice{Id: EntityId{Id: "device-id"}, Name: "d0"})
+		}
+	}))
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
 		t.Fatal(err)
 	}
-	err = user.Login()
+
+	device, err := user.GetDevice(context.Background(), "d0")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	deviceName := "camera-1"
+	if device.Id != "device-id" {
+		t.Fatalf("expected device-id, got %+v", device)
+	}
 
-	device, err := user.GetDevice(deviceName)
-	if err != nil {
+	if n := atomic.LoadInt32(&logins); n != 2 {
+		t.Fatalf("expected 2 logins, got %d", n)
+	}
+}
+
+func TestTenantUser_RefreshBeforeExpiry(t *testing.T) {
+	var refreshes int32
+	fresh := testJwt(time.Now().Add(time.Hour))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case loginEnding:
+			_ = json.NewEncoder(w).Encode(Token{Token: testJwt(time.Now().Add(10 * time.Second)), RefreshToken: "refresh-1"})
+		case refreshTokenEnding:
+			var request RefreshTokenRequest
+			_ = json.NewDecoder(r.Body).Decode(&request)
+			if request.RefreshToken != "refresh-1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			atomic.AddInt32(&refreshes, 1)
+			_ = json.NewEncoder(w).Encode(Token{Token: fresh, RefreshToken: "refresh-2"})
+		case "/api/device/device-id/credentials":
+			if r.Header.Get("X-Authorization") != "Bearer "+fresh {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(Credential{CredentialsId: "token"})
+		}
+	}))
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 
-	log.Printf("device=%+v", device)
+	for i := 0; i < 2; i++ {
+		if _, err := user.GetDeviceAuthToken(context.Background(), "device-id"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Fatalf("expected 1 refresh, got %d", n)
+	}
+
+	if user.RefreshToken != "refresh-2" {
+		t.Fatalf("expected refresh-2, got %s", user.RefreshToken)
+	}
 }
 
-func TestTenantUser_GetDeviceAuthToken(t *testing.T) {
-	s := "http://139.219.2.82:8080"
-	u := "alenym@163.com"
-	p := "123456"
-	user, err := NewTenantUser(s, u, p)
-	if err != nil {
+func TestTenantUser_RetryWithRefreshToken(t *testing.T) {
+	var refreshes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case loginEnding:
+			t.Errorf("login posted without a password")
+			w.WriteHeader(http.StatusUnauthorized)
+		case refreshTokenEnding:
+			var request RefreshTokenRequest
+			_ = json.NewDecoder(r.Body).Decode(&request)
+			n := atomic.AddInt32(&refreshes, 1)
+			if request.RefreshToken != fmt.Sprintf("refresh-%d", n-1) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(Token{Token: fmt.Sprintf("token-%d", n), RefreshToken: fmt.Sprintf("refresh-%d", n)})
+		case "/api/tenant/devices":
+			//the first token is rejected as if it had expired
+			if r.Header.Get("X-Authorization") != "Bearer token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(TBDevice{Id: EntityId{Id: "device-id"}, Name: "d0"})
+		}
+	}))
+	defer server.Close()
+
+	//a user of a saved refresh token has no password
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "")
+	if err := user.LoginWithRefreshToken(context.Background(), "refresh-0"); err != nil {
 		t.Fatal(err)
 	}
-	err = user.Login()
-	if err != nil {
+
+	device, err := user.GetDevice(context.Background(), "d0")
+	if err != nil || device.Id != "device-id" {
+		t.Fatalf("expected device-id, got %+v %v", device, err)
+	}
+	if user.RefreshToken != "refresh-2" {
+		t.Fatalf("expected refresh-2, got %s", user.RefreshToken)
+	}
+
+	//a rejected refresh token is the error, there is no password to fall back to
+	user.Jwt, user.RefreshToken = "Bearer token-1", "expired"
+	if _, err = user.GetDevice(context.Background(), "d0"); err == nil {
+		t.Fatal("expected the rejected refresh token to fail")
+	} else if apiErr, ok := err.(*APIError); !ok || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the refresh error, got %v", err)
+	}
+}
+
+func TestTenantUser_LoginAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"status":401,"message":"Invalid username or password","errorCode":10,"timestamp":1605686400000}`))
+	}))
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "wrong")
+	err := user.Login(context.Background())
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("expected *APIError, got %v", err)
+	}
+
+	if apiErr.StatusCode != http.StatusUnauthorized || apiErr.ErrorCode != ErrorCodeAuthentication {
+		t.Fatalf("unexpected error %+v", apiErr)
+	}
+
+	if len(user.Jwt) > 0 {
+		t.Fatalf("expected no jwt, got %s", user.Jwt)
+	}
+}
+
+func TestTenantUser_APIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == loginEnding:
+			_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+		case r.URL.Path == saveDeviceEnding:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"status":400,"message":"Device name should be specified!","errorCode":31}`))
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"status":404,"message":"Requested item wasn't found!","errorCode":32}`))
+		case r.URL.Path == "/api/tenant/devices":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"status":404,"message":"Requested item wasn't found!","errorCode":32}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("internal error"))
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(ctx); err != nil {
 		t.Fatal(err)
 	}
 
-	deviceId := "cd831170-11d4-11eb-b965-630b63ac6a0e"
+	err := user.CreateDevice(ctx, &Device{})
+	if apiErr, ok := err.(*APIError); !ok || apiErr.ErrorCode != ErrorCodeBadRequestParams {
+		t.Fatalf("expected bad request error, got %v", err)
+	}
+
+	if err = user.DeleteDevice(ctx, "missing"); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	device, err := user.GetDevice(ctx, "missing")
+	if err != nil || len(device.Id) > 0 {
+		t.Fatalf("expected device without id, got %+v, %v", device, err)
+	}
+
+	_, err = user.GetDeviceAuthToken(ctx, "device-id")
+	if apiErr, ok := err.(*APIError); !ok || apiErr.StatusCode != http.StatusInternalServerError || apiErr.Message != "internal error" {
+		t.Fatalf("expected internal server error, got %v", err)
+	}
+}
+
+func TestTenantUser_GetDeviceProfileId(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case loginEnding:
+			_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+		case "/api/deviceProfileInfos":
+			page := DeviceProfileInfoPage{HasNext: r.URL.Query().Get("page") == "0"}
+			if !page.HasNext {
+				page.Data = []DeviceProfileInfo{{Id: EntityId{Id: "id-2"}, Name: "battery"}}
+			} else {
+				page.Data = []DeviceProfileInfo{{Id: EntityId{Id: "id-1"}, Name: "battery-v2"}}
+			}
+			_ = json.NewEncoder(w).Encode(page)
+		}
+	}))
+	defer server.Close()
 
-	authToken, err := user.GetDeviceAuthToken(deviceId)
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := user.GetDeviceProfileId(context.Background(), "battery")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Printf("authToken=%s", authToken)
-	expected := "qvZmJEXmFUAf0lkyuIm6"
-	if authToken != expected {
-		t.Fatalf("not equal")
+	if id != "id-2" {
+		t.Fatalf("expected id-2, got %s", id)
+	}
+
+	if _, err = user.GetDeviceProfileId(context.Background(), "missing"); err != ErrDeviceProfileNotExist {
+		t.Fatalf("expected ErrDeviceProfileNotExist, got %v", err)
 	}
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//points fetched by a single timeseries request
+	verifyPageSize = 10000
+)
+
+var (
+	ErrVerifyFailed = errors.New("verify found lost, duplicated or out of order points")
+)
+
+//RunRecord is what the last run published, saved for verify
+type RunRecord struct {
+	StartTs  int64                      `json:"startTs"` //milliseconds
+	EndTs    int64                      `json:"endTs"`
+	SeqKey   string                     `json:"seqKey"`
+	ServerTs bool                       `json:"serverTs,omitempty"` //thingsboard stamped the messages when they arrived
+	Devices  map[string]DevicePublished `json:"devices"`
+}
+
+//DevicePublished counts the messages a device published in a run
+type DevicePublished struct {
+	Sent  int `json:"sent"`
+	Acked int `json:"acked"`
+}
+
+//Store saves record in store
+func (record *RunRecord) Store(store *DeviceStore) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(KeyRunCmdInfo, data)
+}
+
+func (record *RunRecord) Restore(store *DeviceStore) error {
+	value, err := store.Get(KeyRunCmdInfo)
+	if err != nil {
+		return err
+	}
+
+	if len(value) == 0 {
+		return fmt.Errorf("%s not exist, run before verify", KeyRunCmdInfo)
+	}
+
+	return json.Unmarshal(value, record)
+}
+
+//newRunRecord records results of messages published from start. Timestamps of a client start at the second
+//it started and grow by a millisecond per message, possibly beyond the end of the run. Timestamps given by
+//thingsboard, with serverTs, follow the clock of the server which may be a little ahead.
+func newRunRecord(start time.Time, messageNum int, format string, serverTs bool, results []Result) *RunRecord {
+	record := &RunRecord{
+		StartTs:  start.Unix() * 1000,
+		EndTs:    time.Now().UnixNano()/int64(time.Millisecond) + int64(messageNum) + 1000,
+		SeqKey:   seqKey(format),
+		ServerTs: serverTs,
+		Devices:  make(map[string]DevicePublished, len(results)),
+	}
+
+	for _, result := range results {
+		record.Devices[result.ClientId] = DevicePublished{Sent: result.MessageSent, Acked: result.MessagePublished}
+	}
+	return record
+}
+
+//Delivery is what verify found in the timeseries of a device
+type Delivery struct {
+	Device     string
+	Expected   int //acknowledged messages, which must have been persisted
+	Found      int //points of the sequence key
+	Missing    int //acknowledged sequence numbers without a point
+	Collided   int //sequence numbers without a point which thingsboard may have overwritten, left out of Missing
+	Duplicated int //points beyond the first of a sequence number
+	OutOfOrder int //points with a sequence number below an older point
+}
+
+func (d Delivery) ok() bool {
+	return d.Missing == 0 && d.Duplicated == 0 && d.OutOfOrder == 0
+}
+
+//checkDelivery compares points, oldest first, with the published messages. With serverTs, thingsboard saved
+//every delivery at its arrival and kept one point of a millisecond, so a missing sequence number between two
+//points less than a millisecond per message apart is counted as collided rather than missing.
+func checkDelivery(device string, published DevicePublished, points []TsValue, serverTs bool) (Delivery, error) {
+	delivery := Delivery{Device: device, Expected: published.Acked, Found: len(points)}
+
+	seen := make(map[int]bool, len(points))
+	arrived := make(map[int]int64, len(points))
+	highest := -1
+	for _, point := range points {
+		seq, err := strconv.ParseFloat(fmt.Sprint(point.Value), 64)
+		if err != nil {
+			return delivery, fmt.Errorf("device[%s] has a sequence number %v at %d", device, point.Value, point.Ts)
+		}
+
+		n := int(seq)
+		if seen[n] {
+			delivery.Duplicated++
+			continue
+		}
+		seen[n] = true
+		arrived[n] = point.Ts
+
+		if n < highest {
+			delivery.OutOfOrder++
+		} else {
+			highest = n
+		}
+	}
+
+	present := make([]int, 0, len(arrived))
+	for n := range arrived {
+		present = append(present, n)
+	}
+	sort.Ints(present)
+
+	for n := 0; n < published.Acked; n++ {
+		if seen[n] {
+			continue
+		}
+
+		i := sort.SearchInts(present, n)
+		if serverTs && i > 0 && i < len(present) {
+			before, after := present[i-1], present[i]
+			if span := arrived[after] - arrived[before]; span < int64(after-before) && span > -int64(after-before) {
+				delivery.Collided++
+				continue
+			}
+		}
+		delivery.Missing++
+	}
+	return delivery, nil
+}
+
+type VerifyCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	store   StoreFlags
+	workers int
+}
+
+func newVerifyCommand(m *Main) *VerifyCommand {
+	return &VerifyCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+func (cmd *VerifyCommand) Run(ctx context.Context, args ...string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+
+	help := fs.Bool("h", false, "print this screen")
+	addStoreFlags(fs, &cmd.store)
+	fs.IntVar(&cmd.workers, "workers", 4, "number of devices to verify in parallel")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	} else if *help {
+		fs.Usage()
+		return nil
+	} else if cmd.workers < 1 {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	store, err := cmd.store.Open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = store.Close() }()
+
+	return verifyRun(ctx, cmd.Stdout, store, cmd.workers)
+}
+
+//verifyRun checks the timeseries of every device of the last run for lost, duplicated and out of order points
+func verifyRun(ctx context.Context, w io.Writer, store *DeviceStore, workers int) error {
+	var info InitCommandInfo
+	if err := info.Restore(store); err != nil {
+		return err
+	}
+
+	var record RunRecord
+	if err := record.Restore(store); err != nil {
+		return err
+	}
+
+	user, err := info.tenantUser(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(record.Devices))
+	for name := range record.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	indexes := make([]int, len(names))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	var mu sync.Mutex
+	deliveries := make([]Delivery, 0, len(names))
+	fmt.Fprintf(w, "verifying %s of %d devices\n", record.SeqKey, len(names))
+	err = runWorkers(ctx, w, indexes, workers, func(ctx context.Context, bar *ProgressBar, index int) error {
+		delivery, err := verifyDevice(ctx, user, store, names[index], record)
+		if err != nil {
+			return fmt.Errorf("device[%s]: %v", names[index], err)
+		}
+
+		mu.Lock()
+		deliveries = append(deliveries, delivery)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = saveRefreshToken(store, user); err != nil {
+		return err
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Device < deliveries[j].Device
+	})
+	return printDeliveries(w, deliveries)
+}
+
+//verifyDevice fetches all points of the sequence key published by deviceName
+func verifyDevice(ctx context.Context, user *TenantUser, store *DeviceStore, deviceName string, record RunRecord) (Delivery, error) {
+	device, err := store.GetDevice(deviceName)
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	//devices provisioned over mqtt are stored without id
+	if len(device.Id) == 0 {
+		if device, err = user.GetDevice(ctx, device.Name); err != nil {
+			return Delivery{}, err
+		} else if len(device.Id) == 0 {
+			return Delivery{}, fmt.Errorf("device not exist on thingsboard")
+		}
+	}
+
+	var points []TsValue
+	for startTs := record.StartTs; ; {
+		var page []TsValue
+		if err = withRetry(ctx, func() (err error) {
+			page, err = user.GetTimeseries(ctx, device.Id, record.SeqKey, startTs, record.EndTs, verifyPageSize)
+			return err
+		}); err != nil {
+			return Delivery{}, err
+		}
+
+		points = append(points, page...)
+		if len(page) < verifyPageSize {
+			break
+		}
+		startTs = page[len(page)-1].Ts + 1
+	}
+
+	return checkDelivery(deviceName, record.Devices[deviceName], points, record.ServerTs)
+}
+
+//collided describes the collided points of d, if there are any
+func collided(d Delivery) string {
+	if d.Collided == 0 {
+		return ""
+	}
+	return fmt.Sprintf("  collided: %d", d.Collided)
+}
+
+//printDeliveries prints devices with problems and the totals, it returns ErrVerifyFailed if there are any
+func printDeliveries(w io.Writer, deliveries []Delivery) error {
+	var total Delivery
+	for _, d := range deliveries {
+		if !d.ok() {
+			fmt.Fprintf(w, "device[%s] expected: %d  found: %d  missing: %d  duplicated: %d  out of order: %d%s\n",
+				d.Device, d.Expected, d.Found, d.Missing, d.Duplicated, d.OutOfOrder, collided(d))
+		}
+		total.Expected += d.Expected
+		total.Found += d.Found
+		total.Missing += d.Missing
+		total.Collided += d.Collided
+		total.Duplicated += d.Duplicated
+		total.OutOfOrder += d.OutOfOrder
+	}
+
+	fmt.Fprintf(w, "verified %d devices, expected: %d  found: %d  missing: %d  duplicated: %d  out of order: %d%s\n",
+		len(deliveries), total.Expected, total.Found, total.Missing, total.Duplicated, total.OutOfOrder, collided(total))
+
+	if !total.ok() {
+		return ErrVerifyFailed
+	}
+	return nil
+}
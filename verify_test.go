@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDelivery(t *testing.T) {
+	points := []TsValue{
+		{Ts: 1, Value: "0"},
+		{Ts: 2, Value: "1"},
+		{Ts: 3, Value: "3"},
+		{Ts: 4, Value: "2"},
+		{Ts: 5, Value: 3.0},
+	}
+
+	delivery, err := checkDelivery("device_0", DevicePublished{Sent: 6, Acked: 5}, points, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Delivery{Device: "device_0", Expected: 5, Found: 5, Missing: 1, Duplicated: 1, OutOfOrder: 1}
+	if delivery != expected {
+		t.Fatalf("expected %+v, got %+v", expected, delivery)
+	}
+
+	var out bytes.Buffer
+	if err = printDeliveries(&out, []Delivery{delivery}); err != ErrVerifyFailed {
+		t.Fatalf("expected ErrVerifyFailed, got %v", err)
+	}
+
+	//the unacknowledged last message may or may not be persisted
+	delivery, err = checkDelivery("device_0", DevicePublished{Sent: 3, Acked: 2}, points[:2], false)
+	if err != nil || !delivery.ok() {
+		t.Fatalf("expected complete delivery, got %+v %v", delivery, err)
+	}
+
+	if _, err = checkDelivery("device_0", DevicePublished{}, []TsValue{{Ts: 1, Value: "x"}}, false); err == nil {
+		t.Fatal("expected error for a malformed sequence number")
+	}
+}
+
+func TestCheckDelivery_Collided(t *testing.T) {
+	//seq 1 and 4 arrived in the millisecond of 2 and of 5 and were overwritten, seq 7 had room for a point
+	points := []TsValue{
+		{Ts: 10, Value: "0"},
+		{Ts: 11, Value: "2"},
+		{Ts: 12, Value: "3"},
+		{Ts: 13, Value: "5"},
+		{Ts: 14, Value: "6"},
+		{Ts: 20, Value: "8"},
+	}
+	published := DevicePublished{Sent: 9, Acked: 9}
+
+	delivery, err := checkDelivery("device_0", published, points, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Delivery{Device: "device_0", Expected: 9, Found: 6, Missing: 1, Collided: 2}
+	if delivery != expected {
+		t.Fatalf("expected %+v, got %+v", expected, delivery)
+	}
+
+	var out bytes.Buffer
+	if err = printDeliveries(&out, []Delivery{delivery}); err != ErrVerifyFailed || !strings.Contains(out.String(), "missing: 1  duplicated: 0  out of order: 0  collided: 2") {
+		t.Fatalf("unexpected report %v %s", err, out.String())
+	}
+
+	//timestamps given by the client never collide
+	if delivery, err = checkDelivery("device_0", published, points, false); err != nil || delivery.Missing != 3 || delivery.Collided != 0 {
+		t.Fatalf("expected 3 missing, got %+v %v", delivery, err)
+	}
+}
+
+func TestNewRunRecord(t *testing.T) {
+	start := time.Now()
+	results := []Result{{ClientId: "device_0", MessageSent: 10, MessagePublished: 9}}
+	record := newRunRecord(start, 10, PayloadTypeJson, false, results)
+
+	if record.StartTs > start.UnixNano()/int64(time.Millisecond) || record.EndTs < start.UnixNano()/int64(time.Millisecond)+10 {
+		t.Fatalf("unexpected time range %d-%d", record.StartTs, record.EndTs)
+	}
+
+	if record.SeqKey != jsonSeqKey || record.Devices["device_0"] != (DevicePublished{Sent: 10, Acked: 9}) {
+		t.Fatalf("unexpected record %+v", record)
+	}
+}
+
+func TestTenantUser_GetTimeseries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case loginEnding:
+			_ = json.NewEncoder(w).Encode(Token{Token: "token"})
+		case fmt.Sprintf("/api/plugins/telemetry/DEVICE/%s/values/timeseries", "device-id"):
+			query := r.URL.Query()
+			if query.Get("keys") != jsonSeqKey || query.Get("orderBy") != "ASC" || query.Get("startTs") != "100" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+
+			limit, _ := strconv.Atoi(query.Get("limit"))
+			var points []TsValue
+			for i := 0; i < limit && i < 3; i++ {
+				points = append(points, TsValue{Ts: int64(100 + i), Value: strconv.Itoa(i)})
+			}
+			_ = json.NewEncoder(w).Encode(map[string][]TsValue{jsonSeqKey: points})
+		}
+	}))
+	defer server.Close()
+
+	user, _ := NewTenantUser(server.URL, "tenant@thingsboard.org", "tenant")
+	if err := user.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := user.GetTimeseries(context.Background(), "device-id", jsonSeqKey, 100, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 || points[1].Ts != 101 || points[1].Value != "1" {
+		t.Fatalf("unexpected points %+v", points)
+	}
+}
+
+func TestRunCommand_VerifyFaults(t *testing.T) {
+	server := initFakeServer(t, "-deviceNum", "1")
+
+	//every message is saved twice and after the next one: seq 1 1 0 0 3 3 2 2. Every delivery is saved in a
+	//millisecond of its own, thingsboard would keep only one point of a millisecond.
+	broker := startFakeBroker(t, FakeBrokerOptions{DuplicateRate: 1, ReorderRate: 1})
+	broker.Authenticate = server.Authenticate
+	broker.OnPublish = func(token, topic string, payload []byte) {
+		time.Sleep(2 * time.Millisecond)
+		server.HandlePublish(token, topic, payload)
+	}
+
+	var out bytes.Buffer
+	main := NewMain()
+	main.Stdout = &out
+	args := []string{"run", "-brokerUrl", broker.URL(), "-messageNum", "4", "-timeout", "10", "-serverTs", "-verify"}
+	if err := main.Run(context.Background(), args...); err != ErrVerifyFailed {
+		t.Fatalf("expected %v, got %v", ErrVerifyFailed, err)
+	}
+
+	expected := "expected: 4  found: 8  missing: 0  duplicated: 4  out of order: 2"
+	if !strings.Contains(out.String(), "verified 1 devices, "+expected) {
+		t.Fatalf("expected %s\n%s", expected, out.String())
+	}
+	if stats := broker.Stats(); stats.Duplicated != 4 || stats.Reordered != 2 {
+		t.Fatalf("unexpected broker stats %+v", stats)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	//workspace of the store file itself
+	DefaultWorkspace = "default"
+
+	//how long the workspace list waits for a store written by a running command
+	workspaceLockTimeout = 100 * time.Millisecond
+)
+
+var (
+	workspacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+//StoreFlags locate the store of a workspace. Every workspace has its own file next to the store file, e.g.,
+//store.db holds the default workspace and store.staging.db the workspace staging.
+type StoreFlags struct {
+	Path      string
+	Workspace string
+}
+
+//addStoreFlags defines the flags which locate the store
+func addStoreFlags(fs *flag.FlagSet, s *StoreFlags) {
+	fs.StringVar(&s.Path, "store", DbFileName, "store file of the default workspace, the other workspaces are saved next to it")
+	fs.StringVar(&s.Workspace, "workspace", DefaultWorkspace, "workspace holding its own init info, devices and runs (e.g., staging)")
+}
+
+//File returns the store file of the workspace
+func (s StoreFlags) File() (string, error) {
+	path := s.Path
+	if len(path) == 0 {
+		path = DbFileName
+	}
+
+	if len(s.Workspace) == 0 || s.Workspace == DefaultWorkspace {
+		return path, nil
+	} else if !workspacePattern.MatchString(s.Workspace) {
+		return "", fmt.Errorf("workspace[%s] may only have letters, digits, - and _", s.Workspace)
+	}
+
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + s.Workspace + ext, nil
+}
+
+//Open opens the store of the workspace
+func (s StoreFlags) Open() (*DeviceStore, error) {
+	path, err := s.File()
+	if err != nil {
+		return &DeviceStore{}, err
+	}
+	return OpenDeviceStore(path)
+}
+
+//Workspaces returns the workspaces having a store file next to the store file, by name
+func (s StoreFlags) Workspaces() (map[string]string, error) {
+	path := s.Path
+	if len(path) == 0 {
+		path = DbFileName
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	files, err := filepath.Glob(globEscape(base) + ".*" + globEscape(ext))
+	if err != nil {
+		return nil, err
+	}
+	if exists, _ := filepath.Glob(globEscape(path)); len(exists) > 0 {
+		files = append(files, path)
+	}
+
+	workspaces := make(map[string]string, len(files))
+	for _, file := range files {
+		name := DefaultWorkspace
+		if file != path {
+			name = strings.TrimSuffix(strings.TrimPrefix(file, base+"."), ext)
+		}
+		if name == DefaultWorkspace || workspacePattern.MatchString(name) {
+			workspaces[name] = file
+		}
+	}
+	return workspaces, nil
+}
+
+//globEscape escapes the glob metacharacters of path
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+//printWorkspaces prints every workspace with the server and the number of devices of its init info
+func printWorkspaces(w io.Writer, s StoreFlags) error {
+	workspaces, err := s.Workspaces()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(workspaces))
+	for name := range workspaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "%d workspaces:\n", len(names))
+	for _, name := range names {
+		fmt.Fprintf(w, "- %s (%s)", name, workspaces[name])
+		if info, err := restoreWorkspace(workspaces[name]); err == bolt.ErrTimeout {
+			fmt.Fprintf(w, ": locked by a running command\n")
+		} else if err != nil {
+			fmt.Fprintf(w, ": %v\n", err)
+		} else {
+			fmt.Fprintf(w, ": %s %s, %d devices\n", info.ServerHost, info.Username, info.DeviceNum)
+		}
+	}
+	return nil
+}
+
+//restoreWorkspace reads the init info of the store at path without migrating or locking it for writes
+func restoreWorkspace(path string) (InitCommandInfo, error) {
+	var info InitCommandInfo
+	store, err := OpenDeviceStoreReadOnly(path, workspaceLockTimeout)
+	defer func() { _ = store.Close() }()
+	if err != nil {
+		return info, err
+	}
+
+	err = info.Restore(store)
+	return info, err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestStoreFlags_File(t *testing.T) {
+	cases := []struct {
+		flags    StoreFlags
+		expected string
+	}{
+		{StoreFlags{}, DbFileName},
+		{StoreFlags{Path: "/tmp/tb/store.db", Workspace: DefaultWorkspace}, "/tmp/tb/store.db"},
+		{StoreFlags{Path: "/tmp/tb/store.db", Workspace: "staging"}, "/tmp/tb/store.staging.db"},
+		{StoreFlags{Path: "tbload", Workspace: "perf-cluster"}, "tbload.perf-cluster"},
+	}
+
+	for _, c := range cases {
+		if file, err := c.flags.File(); err != nil || file != c.expected {
+			t.Errorf("%+v: expected %s, got %s %v", c.flags, c.expected, file, err)
+		}
+	}
+
+	if _, err := (StoreFlags{Workspace: "../other"}).File(); err == nil {
+		t.Fatal("expected an invalid workspace to fail")
+	}
+}
+
+func TestInfoCommand_Workspaces(t *testing.T) {
+	server := NewFakeServer(FakeUsername, FakePassword)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "tbload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "stores", "store.db")
+
+	//each workspace holds its own devices
+	main := NewMain()
+	main.Stdout = ioutil.Discard
+	for i, workspace := range []string{DefaultWorkspace, "staging"} {
+		args := []string{"init", "-store", path, "-workspace", workspace, "-namePrefix", workspace,
+			"-deviceNum", []string{"1", "2"}[i], "-serverHost", server.URL, "-username", FakeUsername, "-password", FakePassword}
+		if err = main.Run(context.Background(), args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = os.Stat(DbFileName); !os.IsNotExist(err) {
+		t.Fatalf("expected no store in the current directory, got %v", err)
+	}
+
+	_, devices, err := loadDevices(StoreFlags{Path: path, Workspace: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].Name != "staging_0" {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+
+	var out bytes.Buffer
+	main.Stdout = &out
+	if err = main.Run(context.Background(), "info", "-store", path, "-workspaces"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"2 workspaces:", "- default (" + path + "): " + server.URL + " " + FakeUsername + ", 1 devices",
+		"- staging (" + filepath.Join(dir, "stores", "store.staging.db") + "): " + server.URL + " " + FakeUsername + ", 2 devices"}
+	if printed := strings.TrimSpace(out.String()); printed != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected workspaces\n%s", printed)
+	}
+}
+
+func TestPrintWorkspaces_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tbload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, DbFileName)
+	stagingPath := filepath.Join(dir, "store.staging.db")
+
+	//a store of schema version 1 is listed without migrating it
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte(bucketLegacy))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(KeyInitCmdInfo), []byte(`{"serverHost":"http://localhost:8080","username":"tenant","deviceNum":3}`))
+	})
+	_ = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a store held by a running command is reported as locked
+	running, err := OpenDeviceStore(stagingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = running.Close() }()
+
+	var out bytes.Buffer
+	if err = printWorkspaces(&out, StoreFlags{Path: path, Workspace: DefaultWorkspace}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"2 workspaces:", "- default (" + path + "): http://localhost:8080 tenant, 3 devices",
+		"- staging (" + stagingPath + "): locked by a running command"}
+	if printed := strings.TrimSpace(out.String()); printed != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected workspaces\n%s", printed)
+	}
+
+	db, err = bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketLegacy)) == nil || tx.Bucket([]byte(BucketMeta)) != nil {
+			t.Error("expected the legacy store not migrated")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}